@@ -2,14 +2,16 @@ package main
 
 import (
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	ansi "github.com/k0kubun/go-ansi"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -17,19 +19,36 @@ import (
 var version = "v0.1.62"
 
 var presets = map[string]string{
-	`^\@crf(\d+)$`:   "-an -vcodec libx264 -preset medium -crf ${1} -pix_fmt yuv420p -g 0 -map_metadata -1 -map_chapters -1",
-	`^\@ac(\d+)$`:    "-vn -acodec ac3 -ab ${1}k -map_metadata -1 -map_chapters -1",
-	`^\@flac(\d+)$`:  "-vn -acodec flac -compression_level ${1} -map_metadata -1 -map_chapters -1",
-	`^\@alac(\d+)$`:  "-vn -acodec alac -compression_level ${1} -map_metadata -1 -map_chapters -1",
-	`^\@nometa$`:     "-map_metadata -1 -map_chapters -1",
-	`^\@check(\d+)$`: "-map ${1} -scodec srt -dcodec copy -f null NUL",
-	`^\@jpg$`:        "-q:v 0 -pix_fmt rgb24 -map_metadata -1",
-	`^\@dcpscale$`:   "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf scale=1920:-2,pad=1920:1080:0:(oh-ih)/2,setsar=1/1 -map_metadata -1 -map_chapters -1",
-	`^\@dcpscale2$`:  "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf scale=1920:-2,setsar=1/1 -map_metadata -1 -map_chapters -1",
-	`^\@dcpcrop$`:    "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf crop=1920:ih:(iw-1920)/2:0,pad=1920:1080:0:(oh-ih)/2,setsar=1/1 -map_metadata -1 -map_chapters -1",
-	`^\@sdpal$`:      "-vf scale=720:576,setsar=64/45,unsharp=3:3:0.3:3:3:0",
+	`^\@crf(\d+)$`:         "-an -vcodec libx264 -preset medium -crf ${1} -pix_fmt yuv420p -g 0 -map_metadata -1 -map_chapters -1",
+	`^\@ac(\d+)$`:          "-vn -acodec ac3 -ab ${1}k -map_metadata -1 -map_chapters -1",
+	`^\@flac(\d+)$`:        "-vn -acodec flac -compression_level ${1} -map_metadata -1 -map_chapters -1",
+	`^\@alac(\d+)$`:        "-vn -acodec alac -compression_level ${1} -map_metadata -1 -map_chapters -1",
+	`^\@nometa$`:           "-map_metadata -1 -map_chapters -1",
+	`^\@remux$`:            "-c copy -map 0 -map_metadata -1 -map_chapters -1",
+	`^\@check([\d:s-]+)$`:  "-map ${1} -scodec srt -dcodec copy -f null NUL",
+	`^\@jpg$`:              "-q:v 0 -pix_fmt rgb24 -map_metadata -1",
+	`^\@dcpscale$`:         "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf scale=1920:-2,pad=1920:1080:0:(oh-ih)/2,setsar=1/1 -map_metadata -1 -map_chapters -1",
+	`^\@dcpscale2$`:        "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf scale=1920:-2,setsar=1/1 -map_metadata -1 -map_chapters -1",
+	`^\@dcpcrop$`:          "-loglevel error -stats -an -vcodec libx264 -preset medium -crf 10 -pix_fmt yuv420p -g 0 -vf crop=1920:ih:(iw-1920)/2:0,pad=1920:1080:0:(oh-ih)/2,setsar=1/1 -map_metadata -1 -map_chapters -1",
+	`^\@sdpal$`:            "-vf scale=720:576,setsar=64/45,unsharp=3:3:0.3:3:3:0",
+	`^\@nvenc(\d+)$`:       "-an -vcodec h264_nvenc -preset p5 -rc vbr -cq ${1} -b:v 0 -pix_fmt yuv420p -map_metadata -1 -map_chapters -1",
+	`^\@qsv(\d+)$`:         "-an -vcodec h264_qsv -preset medium -global_quality ${1} -pix_fmt nv12 -map_metadata -1 -map_chapters -1",
+	`^\@vt(\d+)$`:          "-an -vcodec h264_videotoolbox -q:v ${1} -pix_fmt yuv420p -map_metadata -1 -map_chapters -1",
+	`^\@2pass(\d+)$`:       "-an -vcodec libx264 -preset medium -b:v ${1}k -pix_fmt yuv420p -map_metadata -1 -map_chapters -1",
+	`^\@scale(\d+)x(\d+)$`: "-vf scale=${1}:${2},setsar=1/1",
+	`^\@trim(\d+)-(\d+)$`:  "-ss ${1} -to ${2}",
 }
 
+// syncFormats holds codec arguments of sync mode output formats, format name is used as file extension.
+var syncFormats = map[string][]string{
+	"flac": {"-acodec", "flac", "-compression_level", "0"},
+	"ac3":  {"-acodec", "ac3", "-ab", "640k"},
+	"wav":  {"-acodec", "pcm_s24le"},
+}
+
+// userPresets holds the keys of presets loaded from the config file.
+var userPresets = map[string]bool{}
+
 var regexpMap = map[string]*regexp.Regexp{
 	"streamMapping":    regexp.MustCompile(`Stream mapping:`),
 	"encodingFinished": regexp.MustCompile(`.*video:.*audio:.*subtitle:.*global headers:.*`),
@@ -39,27 +58,49 @@ var regexpMap = map[string]*regexp.Regexp{
 	"durationHHMMSSMS": regexp.MustCompile(`.*Duration: (\d{2}\:\d{2}\:\d{2}\.\d{2}).*`),
 	"stream":           regexp.MustCompile(`.*Stream #(\d+\:\d+)(.*?)\: (.*)`),
 	"handler":          regexp.MustCompile(`.*handler_name\ +\:\ +(.+)`),
-	"errors":           regexp.MustCompile(`(.*No such file.*|.*Invalid data.*|.*Unrecognized option.*|.*Option not found.*|.*matches no streams.*|.*not supported.*|.*Invalid argument.*|.*Error.*|.*not exist.*|.*-vf\/-af\/-filter.*|.*No such filter.*|.*does not contain.*|.*Not overwriting - exiting.*|.*denied.*|.*\[y\/N\].*|.*Trailing options were found on the commandline.*|.*unconnected output.*|.*Cannot create the link.*|.*Media type mismatch.*|.*moov atom not found.*|.*Cannot find a matching stream.*|.*Unknown encoder.*|.*experimental codecs are not enabled.*|.*Alternatively use the non experimental encoder.*|.*Failed to configure.*|.*do not match the corresponding output.*|.*cannot be used together.*|.*Invalid out channel name.*|.*Protocol not found.*|.*Invalid loglevel.*|\"quiet\"|\"panic\"|\"fatal\"|\"error\"|\"warning\"|\"info\"|\"verbose\"|\"debug\"|\"trace\"|.*Unable to parse.*|.*already exists. Exiting.*|.*unable to load.*|.*\, line \d+\).*|.*error.*|.*Too many inputs specified.*|.*Import: couldn't open.*|.*failed.*|.*Invalid duration specification.*|.*Unsupported channel layout.*)`),
+	"errors":           regexp.MustCompile(`(.*No such file.*|.*Invalid data.*|.*Unrecognized option.*|.*Option not found.*|.*matches no streams.*|.*not supported.*|.*Invalid argument.*|.*Error.*|.*not exist.*|.*-vf\/-af\/-filter.*|.*No such filter.*|.*does not contain.*|.*Not overwriting - exiting.*|.*denied.*|.*\[y\/N\].*|.*\(y\/N\).*|.*Trailing options were found on the commandline.*|.*unconnected output.*|.*Cannot create the link.*|.*Media type mismatch.*|.*moov atom not found.*|.*Cannot find a matching stream.*|.*Unknown encoder.*|.*experimental codecs are not enabled.*|.*Alternatively use the non experimental encoder.*|.*Failed to configure.*|.*do not match the corresponding output.*|.*cannot be used together.*|.*Invalid out channel name.*|.*Protocol not found.*|.*Invalid loglevel.*|\"quiet\"|\"panic\"|\"fatal\"|\"error\"|\"warning\"|\"info\"|\"verbose\"|\"debug\"|\"trace\"|.*Unable to parse.*|.*already exists. Exiting.*|.*unable to load.*|.*\, line \d+\).*|.*error.*|.*Too many inputs specified.*|.*Import: couldn't open.*|.*failed.*|.*Invalid duration specification.*|.*Unsupported channel layout.*)`),
 	"warnings":         regexp.MustCompile(`(.*Warning:.*|.*Past duration.*too large.*|.*Starting second pass.*|.*At least one output file must be specified.*|.*fontselect:.*|.*Bitrate .* is extremely low, maybe you mean.*|.*parameter is set too low.*|.*Opening.*for reading.*|.*No channel layout for.*|.*Invalid.*index.*|.*EOF timestamp not reliable.*|.*Expected number.*but found.*|.*is not an encoding option*)`),
 
 	// "encoding":         regexp.MustCompile(`.*(time=.*) bitrate=.*(?:\/s|N\/A)(?: |.*)(dup=.*)* *(speed=.*x) *`),
 	// "encodingNoSpeed":  regexp.MustCompile(`.*(time=.*) bitrate=.*(?:\/s|N\/A)(?: |.*)(dup=.*)* *`),
-	"encoding":        regexp.MustCompile(`.*(time=.*) (bitrate=.*(?:\/s|N\/A))(?: |.*)(dup=.*)* *(speed=.*x) *`),
-	"encodingNoSpeed": regexp.MustCompile(`.*(time=.*) (bitrate=.*(?:\/s|N\/A))(?: |.*)(dup=.*)* *`),
+	"encoding":        regexp.MustCompile(`.*(time=.*) (bitrate=.*(?:\/s|N\/A)).*?(speed=.*x) *`),
+	"encodingNoSpeed": regexp.MustCompile(`.*(time=.*) (bitrate=.*(?:\/s|N\/A)).*`),
 
 	"timeSpeed":       regexp.MustCompile(`.*time=.*?(\d{2}\:\d{2}\:\d{2}\.\d{2}).* speed=.*?(\d+\.\d+|\d+)x`),
 	"currentSecond":   regexp.MustCompile(`.*size=.* time=.*?(\d{2}\:\d{2}\:\d{2}\.\d{2}).*`),
+	"frame":           regexp.MustCompile(`frame=\s*(\d+)`),
+	"size":            regexp.MustCompile(`size=\s*(\d+)\s*(kB|KiB|MB|MiB|GB|GiB)`),
+	"fps":             regexp.MustCompile(`fps=\s*(\d+(?:\.\d+)?)`),
+	"dup":             regexp.MustCompile(`dup=\s*(\d+)`),
+	"drop":            regexp.MustCompile(`drop=\s*(\d+)`),
 	"hide":            regexp.MustCompile(`(.*Press \[q\] to stop.*|.*Last message repeated.*)`),
+	"prompt":          regexp.MustCompile(`[\[(]y/N[\])] ?`),
+	"escape":          regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`),
 	"crop":            regexp.MustCompile(`.*cropdetect.*(crop=(-?\d+):(-?\d+):(-?\d+):(-?\d+)).*`),
-	"cropMode":        regexp.MustCompile(`crop(.*)`),
-	"fileNameReplace": regexp.MustCompile(`^(?:(.*)(?:\?))?(.*)\:\:(.*)$`),
+	"cropMode":        regexp.MustCompile(`^(auto)?crop(.*)`),
+	"syncMode":        regexp.MustCompile(`^sync:?(\d*)$`),
+	"fileNameReplace": regexp.MustCompile(`^(?:([^?]*)\?)??(re:.*|[^?]*)\:\:(.*)$`),
 	"filterMapRange1": regexp.MustCompile(`\[(\d+)-(\d+):(\d+)\]`),
 	"filterMapRange2": regexp.MustCompile(`\[(\d+):(\d+)-(\d+)\]`),
 	"filterMapRange3": regexp.MustCompile(`\[(\d+)-(\d+):(\d+)-(\d+)\]`),
+	"timecode":        regexp.MustCompile(`^\d+(:\d{1,2}){0,2}([.,]\d+)?$`),
+	"sequence":        regexp.MustCompile(`%(\d+)?d`),
+	"twoPass":         regexp.MustCompile(`^\@2pass(\d+)$`),
+	"mapRange":        regexp.MustCompile(`^(\d+)(?:-(\d+))?:(\d+)(?:-(\d+))?$`),
+	"filterTypeRange": regexp.MustCompile(`\[(\d+)(?:-(\d+))?:([vVasdt]):(\d+)(?:-(\d+))?\]`),
+	"presetGroup":     regexp.MustCompile(`\(\??[^()]*\)`),
+	"presetRef":       regexp.MustCompile(`\$\{(\d+)\}|\$(\d+)`),
+	"malformedRange":  regexp.MustCompile(`\[[\d-]*(?::[vVasdt])?:[\d-]*\]`),
+	"mapTypeRange":    regexp.MustCompile(`^(\d+)(?:-(\d+))?:([vVasdt]):(\d+)(?:-(\d+))?$`),
+	"ffmpegVersion":   regexp.MustCompile(`ffmpeg version (\S+)`),
+	"ffmpegMajor":     regexp.MustCompile(`^n?(\d+)\.`),
+	"shellSafe":       regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`),
 }
 
 var singlekeys = []string{"-L", "-version", "-buildconf", "-formats", "-muxers", "-demuxers", "-devices", "-codecs", "-decoders", "-encoders", "-bsfs", "-protocols", "-filters", "-pix_fmts", "-layouts", "-sample_fmts", "-colors", "-hwaccels", "-report", "-y", "-n", "-ignore_unknown", "-filter_threads", "-filter_complex_threads", "-stats", "-copy_unknown", "-benchmark", "-benchmark_all", "-stdin", "-dump", "-hex", "-vsync", "-frame_drop_threshold", "-async", "-copyts", "-start_at_zero", "-debug_ts", "-intra", "-sameq", "-same_quant", "-deinterlace", "-psnr", "-vstats", "-vstats_version", "-qphist", "-hwaccel_lax_profile_check", "-isync", "-override_ffserver", "-seek_timestamp", "-apad", "-reinit_filter", "-discard", "-disposition", "-accurate_seek", "-re", "-shortest", "-copyinkf", "-copypriorss", "-thread_queue_size", "-find_stream_info", "-autorotate", "-vn", "-dn", "-intra", "-sameq", "-same_quant", "-deinterlace", "-psnr", "-vstats", "-vstats_version", "-qphist", "-force_fps", "-an", "-guess_layout_max", "-sn", "-fix_sub_duration"}
 
+// hideHandlers are boilerplate stream handler names that are not printed.
+// The list is extended from handlers.json in the config directory.
 var hideHandlers = []string{
 	"VideoHandler",
 	"SoundHandler",
@@ -74,15 +115,44 @@ var hideHandlers = []string{
 }
 
 var isTerminal = true
+var noColor = false
+var ffmpegBin = "ffmpeg"
+var ffprobeBin = "ffprobe"
 var exitStatus = 0
 
+// ffmpegNice is niceness of started ffmpeg processes set with -nice option.
+var ffmpegNice = 0
+
+// progressNewline prints each progress update on its own line instead of overwriting it, set with -no-cr option.
+var progressNewline = false
+
+// progressBar shows progress bar on the progress line, set with -bar option.
+var progressBar = false
+
+// termWidth is the number of terminal columns progress lines are fitted into.
+var termWidth int32 = 80
+
+// runLog is the session log file set with -runlog option.
+var runLog *os.File
+
 func main() {
+	// Reset terminal before crashing, panic leaves colors set and cursor hidden otherwise.
+	defer func() {
+		if r := recover(); r != nil {
+			resetTerminal()
+			panic(r)
+		}
+	}()
+
 	// Main variables.
 	var batchInputName, firstInput string
 	var errors, errorsArray []string
-	var sigint, ffmpeg, nologs, cwdlogs, crop, sync, mute, isBatchInputFile bool
-	var cropDetectNumber int
-	var cropDetectLimit float64
+	var sigint, isBatchInputFile, success bool
+	// Batch summary counters.
+	var succeeded, failed, skipped int
+	// Processed files for -json-report.
+	reportItems := []reportItem{}
+	startTime := time.Now()
 
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -90,12 +160,14 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Intercept interrupt signal
+	// Intercept interrupt signal, interrupted is closed once it arrives.
 	c := make(chan os.Signal, 1)
+	interrupted := make(chan struct{})
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		sigint = true
+		close(interrupted)
 	}()
 
 	// Check if programs output is terminal.
@@ -103,6 +175,26 @@ func main() {
 		isTerminal = false
 	}
 
+	// Respect NO_COLOR convention (https://no-color.org).
+	if os.Getenv("NO_COLOR") != "" {
+		noColor = true
+	}
+
+	// Extend error and warning patterns with user regexps.
+	extendPatterns("errors", os.Getenv("FFLITE_ERROR_PATTERNS"))
+	extendPatterns("warnings", os.Getenv("FFLITE_WARNING_PATTERNS"))
+
+	// Merge custom presets from the config file into presets map.
+	if err := loadPresets(presetsConfigPath()); err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		os.Exit(1)
+	}
+	// Append custom handler names to hide from the config file.
+	if err := loadHideHandlers(handlersConfigPath()); err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		os.Exit(1)
+	}
+
 	// Convert passed arguments into array.
 	args := os.Args[1:]
 	// If program is executed without arguments.
@@ -112,13 +204,95 @@ func main() {
 		os.Exit(0)
 	}
 
-	ffmpeg, nologs, cwdlogs, crop, cropDetectNumber, cropDetectLimit, sync, mute, args = parseOptions(args)
+	opts, args := parseOptions(args)
+	if opts.noColor {
+		noColor = true
+	}
+	ffmpegNice = opts.nice
+	// Carriage returns make a mess of log files, print progress on separate lines if output is not a terminal.
+	progressNewline = opts.noCR || !isTerminal
+	progressBar = opts.bar
+	// Crop mode only runs cropdetect, there is no encode command to print.
+	if opts.crop && opts.dryRun {
+		consolePrint("\x1b[31;1mERROR: crop and dryrun can't be used together.\x1b[0m\n")
+		os.Exit(1)
+	}
+	if opts.multiIn && opts.concat {
+		consolePrint("\x1b[31;1mERROR: multiin and concat can't be used together.\x1b[0m\n")
+		os.Exit(1)
+	}
+	if opts.failFast && opts.retries > 0 {
+		consolePrint("\x1b[31;1mERROR: failfast and -retries can't be used together.\x1b[0m\n")
+		os.Exit(1)
+	}
+	// Pause key can only be read from terminal.
+	if opts.pause && !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		consolePrint("\x1b[33;1mWARNING: pause option requires stdin to be a terminal, ignoring it.\x1b[0m\n")
+		opts.pause = false
+	}
+
+	// Use custom ffmpeg binary if FFLITE_FFMPEG is set.
+	if bin := os.Getenv("FFLITE_FFMPEG"); bin != "" {
+		ffmpegBin = bin
+	}
+	// Use custom ffprobe binary if FFLITE_FFPROBE is set.
+	if bin := os.Getenv("FFLITE_FFPROBE"); bin != "" {
+		ffprobeBin = bin
+	}
+	if _, err := exec.LookPath(ffmpegBin); err != nil && !opts.dryRun {
+		consolePrint("\x1b[31;1mERROR: ffmpeg binary \"" + ffmpegBin + "\" not found. Install FFmpeg or point FFLITE_FFMPEG to it.\x1b[0m\n")
+		os.Exit(1)
+	}
+
+	// Print available hardware encoders.
+	if opts.hwCheck {
+		hwCheck()
+		os.Exit(0)
+	}
+
+	// Output parsing depends on ffmpeg version, warn about untested ones.
+	if !opts.ffmpeg && !opts.dryRun && os.Getenv("FFLITE_NO_FFMPEG_CHECK") == "" {
+		if v, err := ffmpegVersion(); err == nil {
+			if w := ffmpegVersionWarning(v); w != "" {
+				consolePrint("\x1b[33;1mWARNING: " + w + ".\x1b[0m\n")
+			}
+		}
+	}
+
+	// Open progress JSON file or named pipe.
+	if opts.progressJSON != "" {
+		opts.progressFile, err = os.OpenFile(opts.progressJSON, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+		if err != nil {
+			consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+			os.Exit(1)
+		}
+		defer opts.progressFile.Close()
+	}
+
+	// Open session log file.
+	if opts.runLog != "" {
+		runLog, err = os.OpenFile(opts.runLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+		if err != nil {
+			consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+			os.Exit(1)
+		}
+		runLogHeader("fflite " + strings.Join(os.Args[1:], " "))
+	}
 
 	// Create slice containing arguments of ffmpeg command.
 	ffCommand := []string{}
 
+	// Number of arguments after "--" passed to ffmpeg without any processing.
+	rawCount := 0
+
 	// Parse all arguments and apply presets if needed.
 	for i := 0; i < len(args); i++ {
+		// Pass everything after "--" to ffmpeg as is.
+		if args[i] == "--" {
+			rawCount = len(args) - i - 1
+			ffCommand = append(ffCommand, args[i+1:]...)
+			break
+		}
 		if i+1 < len(args) {
 			if (args[i] == "-i") && (firstInput == "") {
 				firstInput = args[i+1]
@@ -154,18 +328,153 @@ func main() {
 			if args[i] == "-filter_complex" {
 				f, err := convertFilterComplexInputs(args[i+1])
 				if err != nil {
-					consolePrint("\x1b[31;1convertFilterComplexInputs: " + err.Error() + "\x1b[0m\n")
+					consolePrint("\x1b[31;1mERROR: -filter_complex: " + err.Error() + "\x1b[0m\n")
 					os.Exit(1)
 				}
+				for _, token := range malformedRanges(f) {
+					consolePrint("\x1b[33;1mWARNING: -filter_complex: \"" + token + "\" is not a valid input range and is passed to ffmpeg as is.\x1b[0m\n")
+				}
 				args[i+1] = f
 			}
+
+			// Convert -map ranges from 0:1-3 to -map 0:1 -map 0:2 -map 0:3.
+			if args[i] == "-map" {
+				maps, err := convertMapRange(args[i+1])
+				if err != nil {
+					consolePrint("\x1b[31;1mconvertMapRange: " + err.Error() + "\x1b[0m\n")
+					os.Exit(1)
+				}
+				for _, m := range maps {
+					ffCommand = append(ffCommand, "-map", m)
+				}
+				i++
+				continue
+			}
+		}
+		// Two-pass preset runs ffmpeg twice.
+		if regexpMap["twoPass"].MatchString(args[i]) {
+			opts.twoPass = true
 		}
-		ffCommand = append(ffCommand, argsPreset(args[i])...)
+		expanded, err := expandMapRanges(argsPreset(args[i]))
+		if err != nil {
+			consolePrint("\x1b[31;1mconvertMapRange: " + err.Error() + "\x1b[0m\n")
+			os.Exit(1)
+		}
+		// Show preset expansions in explain mode.
+		if opts.explain && (len(expanded) != 1 || expanded[0] != args[i]) {
+			consolePrint("\x1b[36;1m" + args[i] + "\x1b[0m -> " + strings.Join(expanded, " ") + "\n")
+		}
+		ffCommand = append(ffCommand, expanded...)
+	}
+
+	// Two-pass encode runs its own ffmpeg commands, it can't detect crop or sync audio.
+	if opts.twoPass && (opts.autoCrop || opts.sync) {
+		consolePrint("\x1b[31;1mERROR: @2pass preset can't be used with autocrop or sync.\x1b[0m\n")
+		os.Exit(1)
+	}
+
+	// Stdin is used up by the batch list, don't let ffmpeg wait for input from it.
+	if batchInputName == "list:-" && !contains(ffCommand, "-nostdin") {
+		ffCommand = append([]string{"-nostdin"}, ffCommand...)
+	}
+
+	// Add overwrite policy unless it is already set in the command.
+	if opts.overwrite != "" && !contains(ffCommand, "-y") && !contains(ffCommand, "-n") {
+		ffCommand = append([]string{opts.overwrite}, ffCommand...)
+	}
+
+	// Parsing of ffmpeg output relies on the default info loglevel.
+	if level, ok := loglevel(args); ok && !opts.ffmpeg {
+		switch {
+		case level > loglevels["info"]:
+			consolePrint("\x1b[33;1mWARNING: -loglevel above info prints extra lines that can be mistaken for errors.\x1b[0m\n")
+		case level < loglevels["info"] && !contains(args, "-stats"):
+			consolePrint("\x1b[33;1mWARNING: -loglevel below info hides progress, add -stats to show it.\x1b[0m\n")
+		}
+	}
+
+	// Crop is detected in the first input only.
+	if inputs := commandInputs(ffCommand); (opts.crop || opts.autoCrop) && len(inputs) > 1 {
+		consolePrint("\x1b[33;1mWARNING: crop is detected in the first input only, " + strconv.Itoa(len(inputs)-1) + " other inputs are ignored.\x1b[0m\n")
+	}
+
+	// Warn about contradicting options, presets can silently disable streams set up by hand.
+	for _, w := range commandConflicts(ffCommand) {
+		consolePrint("\x1b[33;1mWARNING: " + w + "\x1b[0m\n")
 	}
 
-	// If .txt file or glob pattern is passed as input start batch process.
-	// Input will be replaced with each line from that file.
-	if batchInputName != "" {
+	// Multi-input mode passes all batch files as inputs of a single command.
+	if opts.multiIn && batchInputName != "" {
+		files, err := sliceFromFileOrGlob(batchInputName, isBatchInputFile)
+		if err != nil {
+			consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+			os.Exit(1)
+		}
+		if opts.natsort {
+			sort.SliceStable(files, func(i, j int) bool {
+				return naturalLess(files[i], files[j])
+			})
+		}
+		if len(files) < 1 {
+			consolePrint("\x1b[31;1mERROR: No files matching \"" + batchInputName + "\".\x1b[0m\n")
+			os.Exit(1)
+		}
+		index := stringIndexInSlice(ffCommand, batchInputName)
+		inputs := []string{}
+		for _, file := range files {
+			inputs = append(inputs, "-i", file)
+		}
+		ffCommand = append(append(append([]string{}, ffCommand[:index-1]...), inputs...), ffCommand[index+1:]...)
+		batchInputName = ""
+	}
+
+	// Resolved ffmpeg command before input and output names are substituted.
+	commandTemplate := append([]string{}, ffCommand...)
+	// Arguments from rawStart were passed after "--", their names are not replaced.
+	rawStart := len(ffCommand) - rawCount
+
+	// Concat mode joins all batch inputs into one output.
+	if opts.concat {
+		if batchInputName == "" {
+			consolePrint("\x1b[31;1mERROR: concat needs \".txt\" filelist, \"list:\" or a glob pattern as input.\x1b[0m\n")
+			os.Exit(1)
+		}
+		files, err := sliceFromFileOrGlob(batchInputName, isBatchInputFile)
+		if err != nil {
+			consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+			os.Exit(1)
+		}
+		if opts.natsort {
+			sort.SliceStable(files, func(i, j int) bool {
+				return naturalLess(files[i], files[j])
+			})
+		}
+		if len(files) < 1 {
+			consolePrint("\x1b[31;1mERROR: No files matching \"" + batchInputName + "\" to concat.\x1b[0m\n")
+			os.Exit(1)
+		}
+		runLogHeader("CONCAT: " + batchInputName)
+		encodeStartTime := time.Now()
+		filename := ""
+		errors, filename, success = concatEncode(ffCommand, stringIndexInSlice(ffCommand, batchInputName), files, opts)
+		item := reportItem{Input: batchInputName, Outputs: []string{ffCommand[len(ffCommand)-1]}, Status: "ok", Elapsed: time.Since(encodeStartTime).Seconds(), Errors: reportErrors(errors)}
+		if !success {
+			item.Status = "failed"
+		}
+		reportItems = append(reportItems, item)
+		// Append errors to errorsArray.
+		if len(errors) > 0 {
+			errorsArray = append(errorsArray, "\x1b[42;1mINPUT:\x1b[0m\x1b[32;1m "+filename+"\x1b[0m\n")
+			errorsArray = append(errorsArray, errors...)
+			if !opts.nologs {
+				logpath := logPath(filename, opts.logName, cwd, opts.cwdlogs)
+
+				writeStringArrayToFile(logpath, errorsArray, 0775)
+			}
+		}
+	} else if batchInputName != "" {
+		// If .txt file or glob pattern is passed as input start batch process.
+		// Input will be replaced with each line from that file.
 		// Get index of batch file.
 		batchInputIndex := stringIndexInSlice(ffCommand, batchInputName)
 		batchArray, err := sliceFromFileOrGlob(batchInputName, isBatchInputFile)
@@ -173,7 +482,19 @@ func main() {
 			consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
 			os.Exit(1)
 		}
+		if opts.natsort {
+			sort.SliceStable(batchArray, func(i, j int) bool {
+				return naturalLess(batchArray[i], batchArray[j])
+			})
+		}
 		batchArrayLength := len(batchArray)
+		// Create output directory.
+		if opts.outDir != "" && !opts.dryRun {
+			if err := prepareOutDir(opts.outDir); err != nil {
+				consolePrint("\x1b[31;1mERROR: " + err.Error() + "\x1b[0m\n")
+				os.Exit(1)
+			}
+		}
 		if batchArrayLength < 1 {
 			if isBatchInputFile {
 				consolePrint("\x1b[31;1mERROR: \"" + batchInputName + "\" is empty.\x1b[0m\n")
@@ -185,6 +506,16 @@ func main() {
 		if !isBatchInputFile {
 			consolePrint("\x1b[30;1mINPUT(", batchArrayLength, "): ", strings.Join(batchArray, ", "), "\x1b[0m\n")
 		}
+		// Get durations of all batch files for total batch ETA.
+		batchDurations := make([]float64, batchArrayLength)
+		if !opts.crop && !opts.dryRun {
+			for i, file := range batchArray {
+				batchDurations[i] = getDuration(file)
+			}
+		}
+		// Encoded duration of files with known duration and time spent encoding them.
+		var batchEncoded float64
+		var batchElapsed time.Duration
 		// For each file.
 		for i, file := range batchArray {
 			filename := ""
@@ -196,42 +527,134 @@ func main() {
 				copy(batchCommand, ffCommand)
 				// Replace batch input file with filename.
 				batchCommand[batchInputIndex] = file
+				// Resolved output filenames.
+				outputs := []string{}
 				// Iterate over all arguments.
 				for i := 0; i < len(batchCommand); i++ {
 					if i+1 < len(batchCommand) {
 						// For each input filename except the first one.
-						if (batchCommand[i] == "-i") && (firstInput != "") && (regexpMap["fileNameReplace"].MatchString(batchCommand[i+1])) {
+						if (batchCommand[i] == "-i") && (firstInput != "") && i+1 < rawStart && (regexpMap["fileNameReplace"].MatchString(batchCommand[i+1])) {
 							// Replace input filename if it contains "[prefix?]old::new" pattern.
-							match := regexpMap["fileNameReplace"].FindStringSubmatch(batchCommand[i+1])
-							batchCommand[i+1] = match[1] + strings.Replace(firstInput, match[2], match[3], -1)
+							batchCommand[i+1] = replaceFileName(batchCommand[i+1], firstInput)
 						}
-						if (batchCommand[i] == "-i") && (firstInput == "") {
+						if (batchCommand[i] == "-i") && (firstInput == "") && i+1 < rawStart {
 							firstInput = batchCommand[i+1]
 						}
 					}
 					// For each output filename.
-					if !(strings.HasPrefix(batchCommand[i], "-")) && (batchCommand[i] != "NUL") && (!(strings.HasPrefix(batchCommand[i-1], "-")) || batchCommand[i-1] == "-1" || contains(singlekeys, batchCommand[i-1])) {
+					if !(strings.HasPrefix(batchCommand[i], "-")) && !isNullSink(batchCommand[i]) && (!(strings.HasPrefix(batchCommand[i-1], "-")) || batchCommand[i-1] == "-1" || contains(singlekeys, batchCommand[i-1])) {
+						// Outputs passed after "--" are used as is.
+						if i >= rawStart {
+							outputs = append(outputs, batchCommand[i])
+							continue
+						}
 						// Replace filename if it contains "[prefix?]old::new" pattern, append the output to input otherwise.
 						if regexpMap["fileNameReplace"].MatchString(batchCommand[i]) {
-							match := regexpMap["fileNameReplace"].FindStringSubmatch(batchCommand[i])
-							// consolePrint("\nDEBUG:", match, "\n")
-							batchCommand[i] = match[1] + strings.Replace(filepath.Base(firstInput), match[2], match[3], -1)
+							batchCommand[i] = replaceFileName(batchCommand[i], filepath.Base(firstInput))
+							// Put renamed output into output directory if it is set.
+							if opts.outDir != "" && !filepath.IsAbs(batchCommand[i]) {
+								batchCommand[i] = filepath.Join(opts.outDir, batchCommand[i])
+							}
+						} else if opts.outDir != "" {
+							batchCommand[i] = filepath.Join(opts.outDir, filepath.Base(basename)+"_"+batchCommand[i])
 						} else {
 							batchCommand[i] = basename + "_" + batchCommand[i]
 						}
+						outputs = append(outputs, batchCommand[i])
 					}
 				}
-				consolePrint("\n\x1b[42;1mINPUT " + strconv.FormatInt(int64(i)+1, 10) + " of " + strconv.FormatInt(int64(batchArrayLength), 10) + "\x1b[0m\n")
-				switch {
+				banner := "\x1b[42;1mINPUT " + strconv.FormatInt(int64(i)+1, 10) + " of " + strconv.FormatInt(int64(batchArrayLength), 10) + "\x1b[0m"
+				eta := ""
+				if !opts.crop && !opts.dryRun {
+					eta = " \x1b[30;1mbatch eta=" + batchETA(batchDurations[i:], batchEncoded, batchElapsed) + "\x1b[0m"
+				}
+				// Show the input filename, so each section of saved logs is self-describing.
+				banner = "\n" + banner + " \x1b[32;1m" + fitBannerName(file, displayWidth(banner+eta)+1) + "\x1b[0m" + eta
+				runLogHeader("INPUT " + strconv.Itoa(i+1) + " of " + strconv.Itoa(batchArrayLength) + ": " + file)
+				consolePrint(banner + "\n")
+				// Skip the file if all of its outputs already exist.
+				if opts.skipExisting && !opts.crop && outputsExist(outputs) {
+					consolePrint("\x1b[33;1mSKIPPED: output already exists: \x1b[33m" + strings.Join(outputs, ", ") + "\x1b[0m\n")
+					skipped++
+					reportItems = append(reportItems, reportItem{Input: firstInput, Outputs: outputs, Status: "skipped", Errors: []string{}})
+					continue
+				}
 				// Run cropDetect if crop mode is enabled.
-				case crop:
-					cropDetect(firstInput, cropDetectNumber, cropDetectLimit)
+				if opts.crop && !opts.dryRun {
+					c, ok := cropDetect(firstInput, opts.cropDetectNumber, opts.cropDetectLimit, opts.cropDetectTimes)
+					if opts.cropOut != "" {
+						writeCropRow(opts.cropOut, firstInput, c, ok)
+					}
 					continue
-				// Run audioSync if sync mode is enabled.
-				case sync:
-					errors, filename = audioSync(batchCommand, true)
-				default:
-					errors, filename = encodeFile(batchCommand, true, ffmpeg, mute)
+				}
+				// Stop the batch if output filesystem is running out of space.
+				if opts.minFree > 0 && !opts.dryRun {
+					if err := checkFreeSpace(outputs, opts.minFree); err != nil {
+						consolePrint("\x1b[31;1mERROR: " + err.Error() + "\x1b[0m\n")
+						exitStatus = 1
+						break
+					}
+				}
+				fileStartTime := time.Now()
+				// Retry failed encodes if retries are enabled.
+				exitStatusBefore := exitStatus
+				var attemptStartTime time.Time
+				for attempt := 1; ; attempt++ {
+					attemptStartTime = time.Now()
+					switch {
+					// Run ffmpeg twice with two-pass preset.
+					case opts.twoPass:
+						errors, filename, success = twoPassEncode(batchCommand, true, opts)
+					// Only print the command in dry run mode.
+					case opts.dryRun:
+						errors, filename, success = encodeFile(batchCommand, true, opts)
+					// Detect crop and encode with it if autocrop mode is enabled.
+					case opts.autoCrop:
+						errors, filename, success = autoCrop(batchCommand, true, opts)
+					// Run audioSync if sync mode is enabled.
+					case opts.sync:
+						errors, filename, success = audioSync(batchCommand, true, opts)
+					default:
+						errors, filename, success = encodeFile(batchCommand, true, opts)
+					}
+					if success || sigint || attempt > opts.retries {
+						break
+					}
+					consolePrint("\x1b[33;1mRetrying (" + strconv.Itoa(attempt) + "/" + strconv.Itoa(opts.retries) + ")...\x1b[0m\n")
+					// Interrupt signal stops waiting for the next attempt.
+					backoff := time.NewTimer(time.Duration(attempt) * 2 * time.Second)
+					select {
+					case <-interrupted:
+						backoff.Stop()
+					case <-backoff.C:
+					}
+					if sigint {
+						break
+					}
+				}
+				if success {
+					// Don't fail the run if one of the retries succeeded.
+					exitStatus = exitStatusBefore
+					succeeded++
+				} else {
+					failed++
+				}
+				item := reportItem{Input: firstInput, Outputs: outputs, Status: "ok", Elapsed: time.Since(fileStartTime).Seconds(), Errors: reportErrors(errors)}
+				if !success {
+					item.Status = "failed"
+				}
+				reportItems = append(reportItems, item)
+				// Append encoding time of the file to timings report.
+				if opts.timings != "" && success && !opts.dryRun {
+					writeTimings(opts.timings, firstInput, outputs, batchDurations[i], time.Since(attemptStartTime))
+				}
+				// Flush session log after each file.
+				if runLog != nil {
+					runLog.Sync()
+				}
+				if batchDurations[i] > 0 {
+					batchEncoded += batchDurations[i]
+					batchElapsed += time.Since(fileStartTime)
 				}
 				// Append errors to errorsArray.
 				if len(errors) > 0 {
@@ -241,75 +664,104 @@ func main() {
 					errorsArray = append(errorsArray, "\x1b[42;1mINPUT "+strconv.FormatInt(int64(i)+1, 10)+":\x1b[0m\x1b[32;1m "+filename+"\x1b[0m\n")
 					errorsArray = append(errorsArray, errors...)
 
-					logpath := firstInput + ".#err"
-					if cwdlogs {
-						logpath = filepath.Join(cwd, filepath.Base(firstInput)) + ".#err"
-					}
+					if !opts.nologs {
+						logpath := logPath(firstInput, opts.logName, cwd, opts.cwdlogs)
 
-					if nologs {
-						continue
+						writeStringArrayToFile(logpath, []string{"INPUT: " + filename + "\n"}, 0775)
+						writeStringArrayToFile(logpath, errors, 0775)
 					}
-
-					writeStringArrayToFile(logpath, []string{"INPUT: " + filename + "\n"}, 0775)
-					writeStringArrayToFile(logpath, errors, 0775)
+				}
+				// Stop the batch on the first failed file in failfast mode.
+				if opts.failFast && !success && !opts.dryRun {
+					consolePrint("\x1b[31;1mFAILFAST: stopping the batch, " + strconv.Itoa(batchArrayLength-i-1) + " files left unprocessed.\x1b[0m\n")
+					exitStatus = 1
+					break
 				}
 			}
 		}
 		// Play bell sound.
-		bell(mute)
+		bell(opts.mute || opts.dryRun, exitStatus != 0)
+		// Send desktop notification.
+		if opts.notify && !opts.dryRun {
+			notify("fflite", "batch complete — "+strconv.Itoa(succeeded)+" ok, "+strconv.Itoa(failed)+" failed")
+		}
 	} else {
 		filename := ""
 		firstInput = ""
+		// Resolved output filenames.
+		outputs := []string{}
 		// For each output filename.
 		for i := 0; i < len(ffCommand); i++ {
 			if i+1 < len(ffCommand) {
 				// For each input filename except the first one.
-				if (ffCommand[i] == "-i") && (firstInput != "") && (regexpMap["fileNameReplace"].MatchString(ffCommand[i+1])) {
+				if (ffCommand[i] == "-i") && (firstInput != "") && i+1 < rawStart && (regexpMap["fileNameReplace"].MatchString(ffCommand[i+1])) {
 					// Replace input filename if it contains "[prefix?]old::new" pattern.
-					match := regexpMap["fileNameReplace"].FindStringSubmatch(ffCommand[i+1])
-					ffCommand[i+1] = match[1] + strings.Replace(firstInput, match[2], match[3], -1)
+					ffCommand[i+1] = replaceFileName(ffCommand[i+1], firstInput)
 				}
 				if (ffCommand[i] == "-i") && (firstInput == "") {
 					firstInput = ffCommand[i+1]
 				}
 			}
 			if i > 0 {
-				if !(strings.HasPrefix(ffCommand[i], "-")) && (ffCommand[i] != "NUL") && (!(strings.HasPrefix(ffCommand[i-1], "-")) || ffCommand[i-1] == "-1") && (regexpMap["fileNameReplace"].MatchString(ffCommand[i])) {
+				if !(strings.HasPrefix(ffCommand[i], "-")) && !isNullSink(ffCommand[i]) && (!(strings.HasPrefix(ffCommand[i-1], "-")) || ffCommand[i-1] == "-1") && i < rawStart && (regexpMap["fileNameReplace"].MatchString(ffCommand[i])) {
 					// Replace output filename if it contains "[prefix?]old::new" pattern.
-					match := regexpMap["fileNameReplace"].FindStringSubmatch(ffCommand[i])
-					ffCommand[i] = match[1] + strings.Replace(firstInput, match[2], match[3], -1)
+					ffCommand[i] = replaceFileName(ffCommand[i], firstInput)
 				}
+				if !(strings.HasPrefix(ffCommand[i], "-")) && !isNullSink(ffCommand[i]) && (!(strings.HasPrefix(ffCommand[i-1], "-")) || ffCommand[i-1] == "-1" || contains(singlekeys, ffCommand[i-1])) {
+					outputs = append(outputs, ffCommand[i])
+				}
+			}
+		}
+		// Don't start if output filesystem has not enough free space.
+		if opts.minFree > 0 && !opts.dryRun && !opts.crop {
+			if err := checkFreeSpace(outputs, opts.minFree); err != nil {
+				consolePrint("\x1b[31;1mERROR: " + err.Error() + "\x1b[0m\n")
+				os.Exit(1)
 			}
 		}
+		runLogHeader("INPUT: " + firstInput)
+		encodeStartTime := time.Now()
 		switch {
+		// Run ffmpeg twice with two-pass preset.
+		case opts.twoPass && !opts.crop:
+			errors, filename, success = twoPassEncode(ffCommand, false, opts)
+		// Only print the command in dry run mode.
+		case opts.dryRun:
+			errors, filename, success = encodeFile(ffCommand, false, opts)
 		// Run cropDetect if crop mode is enabled.
-		case crop:
-			cropDetect(firstInput, cropDetectNumber, cropDetectLimit)
+		case opts.crop:
+			c, ok := cropDetect(firstInput, opts.cropDetectNumber, opts.cropDetectLimit, opts.cropDetectTimes)
+			if opts.cropOut != "" {
+				writeCropRow(opts.cropOut, firstInput, c, ok)
+			}
 			return
+		// Detect crop and encode with it if autocrop mode is enabled.
+		case opts.autoCrop:
+			errors, filename, success = autoCrop(ffCommand, false, opts)
 		// Run audioSync if sync mode is enabled.
-		case sync:
-			errors, filename = audioSync(ffCommand, false)
+		case opts.sync:
+			errors, filename, success = audioSync(ffCommand, false, opts)
 		default:
-			errors, filename = encodeFile(ffCommand, false, ffmpeg, mute)
+			errors, filename, success = encodeFile(ffCommand, false, opts)
+		}
+		// Append encoding time of the file to timings report.
+		if opts.timings != "" && success && !opts.dryRun {
+			writeTimings(opts.timings, firstInput, outputs, getDuration(firstInput), time.Since(encodeStartTime))
 		}
+		item := reportItem{Input: firstInput, Outputs: outputs, Status: "ok", Elapsed: time.Since(encodeStartTime).Seconds(), Errors: reportErrors(errors)}
+		if !success {
+			item.Status = "failed"
+		}
+		reportItems = append(reportItems, item)
 		// Append errors to errorsArray.
 		if len(errors) > 0 {
 			errorsArray = append(errorsArray, "\x1b[42;1mINPUT:\x1b[0m\x1b[32;1m "+filename+"\x1b[0m\n")
 			errorsArray = append(errorsArray, errors...)
-			if nologs {
-				return
-			}
+			if !opts.nologs {
+				logpath := logPath(firstInput, opts.logName, cwd, opts.cwdlogs)
 
-			logpath := firstInput + ".#err"
-			if cwdlogs {
-				logpath = filepath.Join(cwd, filepath.Base(firstInput)) + ".#err"
+				writeStringArrayToFile(logpath, errorsArray, 0775)
 			}
-
-			if nologs {
-				return
-			}
-
-			writeStringArrayToFile(logpath, errorsArray, 0775)
 		}
 	}
 
@@ -321,7 +773,38 @@ func main() {
 		}
 	}
 
+	// Print out batch summary.
+	if batchInputName != "" && !opts.concat && !opts.crop && !opts.dryRun {
+		printBatchSummary(succeeded+failed+skipped, succeeded, failed, skipped, time.Since(startTime))
+	}
+
+	// Post run results to webhook.
+	if opts.webhook != "" && !opts.dryRun {
+		payload := webhookPayload{Files: succeeded + failed + skipped, Succeeded: succeeded, Failed: failed, Skipped: skipped}
+		if batchInputName == "" || opts.concat {
+			payload.Files = 1
+			if exitStatus == 0 {
+				payload.Succeeded = 1
+			} else {
+				payload.Failed = 1
+			}
+		}
+		payload.Duration = time.Since(startTime).Seconds()
+		payload.ExitStatus = exitStatus
+		postWebhook(opts.webhook, payload)
+	}
+
+	// Write JSON report of the run.
+	if opts.jsonReport != "" && !opts.dryRun && !opts.crop {
+		writeJSONReport(opts.jsonReport, runReport{Command: commandTemplate, Items: reportItems, Duration: time.Since(startTime).Seconds(), ExitStatus: exitStatus})
+	}
+
+	if runLog != nil {
+		runLogHeader("finished with exit status " + strconv.Itoa(exitStatus))
+		runLog.Close()
+	}
+
 	// Show cursor in case its hidden before exit.
-	ansi.CursorShow()
+	showCursor()
 	os.Exit(exitStatus)
 }
@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"math"
@@ -14,14 +17,19 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	ansi "github.com/k0kubun/go-ansi"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // help returns usage information and programm version.
@@ -30,26 +38,114 @@ func help() {
 	consolePrint("fflite version \x1b[33;1m" + version + "\x1b[0m.\n")
 	consolePrint("\n\x1b[33;1mUsage:\x1b[0m\n")
 	consolePrint("    It uses the same syntax as FFmpeg:\n\n")
-	consolePrint("    fflite [fflite_option] [global_options] {[input_file_options] -i input_file} ... {[output_file_options] output_file} ...\n\n")
+	consolePrint("    fflite [fflite_options] [global_options] {[input_file_options] -i input_file} ... {[output_file_options] output_file} ...\n\n")
+	consolePrint("    Several fflite options can be combined (\"fflite nologs mute -i input_file output_file\").\n")
 	consolePrint("    For batch execution pass \".txt\" filelist, \"list:file1 file2 \"file 3\"\" or a glob pattern as input.\n")
+	consolePrint("    \"list:-\" reads filelist from stdin (\"find . -name *.mov | fflite -i list:- @crf18 out.mp4\").\n")
+	consolePrint("    Blank lines and lines starting with \"#\" (after optional whitespace) are ignored in \".txt\" filelists.\n")
 	consolePrint("    Once the first input file is specified input and output files can be named using `[prefix?]old::new` pattern. This will take the first input name and replace `old` string with the `new` string. If `?` is present, everything before `?` will be used as a prefix for new filenames (`fflite -i film_video.mp4 -map 0:a folder?video.mp4::audio.ac3`).\n")
+	consolePrint("    If `old` starts with `re:` it is used as a regular expression and `new` can contain `$1` group references (`fflite -i film_v02.mp4 re:_v\\d+\\.mp4$::.mkv`).\n")
 	consolePrint("    Input ranges can be passed to -filter_complex. \"[0-1:1]\" becomes \"[0:1][1:1]\"; \"[0:0-1]\" becomes \"[0:0][0:1]\"; \"[0-1:2-3]\" becomes \"[0:2][0:3][1:2][1:3]\" and so on. Example: \"-filter_complex [0:1-6]amerge=inputs=6[a]\" becomes \"-filter_complex [0:1][0:2][0:3][0:4][0:5][0:6]amerge=inputs=6[a]\".\n")
+	consolePrint("    Stream ranges can be passed to -map. \"-map 0:1-3\" becomes \"-map 0:1 -map 0:2 -map 0:3\", \"0-1:2\" and \"0-1:2-3\" forms are also supported.\n")
+	consolePrint("    Ranges can contain stream type: \"[0:a:0-2]\" becomes \"[0:a:0][0:a:1][0:a:2]\" and \"-map 0:s:0-1\" becomes \"-map 0:s:0 -map 0:s:1\".\n")
 	consolePrint("    Preset arguments are replaced with specific strings.\n")
+	consolePrint("    Arguments after \"--\" are passed to ffmpeg as is, without preset, range and \"old::new\" processing.\n")
+	consolePrint("    Custom presets are loaded from \"" + presetsConfigPath() + "\" and override built-in ones.\n")
+	consolePrint("    Extra stream handler names to hide are loaded from \"" + handlersConfigPath() + "\".\n")
 	consolePrint("\n\x1b[33;1mOptions:\x1b[0m\n")
 	consolePrint("    ffmpeg       original ffmpeg text output\n")
+	consolePrint("    banner       don't add \"-hide_banner\" to ffmpeg command, it is added by default to hide version and build configuration\n")
 	consolePrint("    version      print fflite version and check for updates\n")
-	consolePrint("    update       update fflite version using \"go get\"\n")
+	consolePrint("    version-json print current and latest versions as JSON, exits with 1 if update is available and 2 if the check failed\n")
+	consolePrint("    update       update fflite version using \"go install\"\n")
+	consolePrint("    completion shell\n")
+	consolePrint("                 print completion script for bash, zsh or fish (\"source <(fflite completion bash)\")\n")
 	consolePrint("    nologs       do not create \".#err\" error log files\n")
 	consolePrint("    cwdlogs      save \".#err\" error log files in the current work directory\n")
+	consolePrint("    -logname template\n")
+	consolePrint("                 error log filename template with {dir}, {base}, {ext} and {date} placeholders, \"{dir}/{base}{ext}.#err\" by default\n")
 	consolePrint("    crop         audomated cropDetect module \"fflite crop[crop_number:crop_limit] -i input_file\"\n")
-	consolePrint("    sync         sync 2nd input audio files duration to the duration on the first input \"fflite sync -i input_file -i input_file\"\n")
+	consolePrint("    autocrop     detect crop and encode with it \"fflite autocrop[crop_number:crop_limit] @crf18 -i input_file output_file\"\n")
+	consolePrint("                 samples can be taken at explicit timecodes with \"crop@00:05:00,00:30:00\" or \"autocrop@00:05:00,00:30:00\"\n")
+	consolePrint("    sync         sync audio duration of 2nd and following inputs to the duration of the first input \"fflite sync[:sample_rate] -i input_file -i input_file\"\n")
+	consolePrint("    -sync-format format\n")
+	consolePrint("                 sync mode output format: flac (default), ac3 or wav\n")
 	consolePrint("    mute         removes bell sound at the end of ecoding\n")
+	consolePrint("    skipexisting skip batch items if all of their output files already exist\n")
+	consolePrint("    dryrun       print final ffmpeg commands for every input without executing them\n")
+	consolePrint("    nocolor      disable colored output, same as setting NO_COLOR environment variable\n")
+	consolePrint("    progresspipe read progress from ffmpeg \"-progress pipe:3\" output instead of parsing stats lines (not supported on Windows)\n")
+	consolePrint("    quiet        print only errors and the final result of each file\n")
+	consolePrint("    debug        print raw ffmpeg lines dimmed to stderr before parsed output\n")
+	consolePrint("    notify       send desktop notification when batch is finished\n")
+	consolePrint("    pause        press \"p\" to pause and resume ffmpeg, other keys are passed to ffmpeg (not supported on Windows)\n")
+	consolePrint("    decimalpercent\n")
+	consolePrint("                 show progress percentage with one decimal place (37.4%) for long encodes\n")
+	consolePrint("    failfast     stop the batch on the first failed file and exit with non-zero status, can't be used with -retries\n")
+	consolePrint("    natsort      sort batch files in natural order (file2 before file10)\n")
+	consolePrint("    multiin      pass all batch inputs as \"-i\" inputs of a single command \"fflite multiin -i *.wav -filter_complex [0-5:0]amerge=inputs=6 out.wav\"\n")
+	consolePrint("    concat       join batch inputs into one output with concat demuxer and stream copy \"fflite concat -i *.ts out.mp4\"\n")
+	consolePrint("    handlers     print handler name of each input stream on its line \"0:1 (eng) Audio: aac, 48000 Hz, stereo (SoundHandler)\"\n")
+	consolePrint("    statsline    print \"FFLITE_STATS elapsed=... speed=... frames=... size=...\" line to stderr after single file encoding\n")
+	consolePrint("    presets-json print all presets as JSON\n")
+	consolePrint("    hwcheck      print hardware acceleration methods and hardware encoders that work on this machine\n")
+	consolePrint("    -eta-window N\n")
+	consolePrint("                 number of speed samples averaged for ETA, 30 by default, 1 for instantaneous ETA\n")
+	consolePrint("    -warn-limit N\n")
+	consolePrint("                 number of repeated warnings shown before omitting them, 10 by default, 0 to never omit\n")
+	consolePrint("    -retries N   retry failed batch items up to N times before logging them as failed\n")
+	consolePrint("    -stall-timeout N\n")
+	consolePrint("                 kill ffmpeg if there is no encoding progress for N seconds\n")
+	consolePrint("    -progress-json path\n")
+	consolePrint("                 write progress updates as newline-delimited JSON to file or named pipe\n")
+	consolePrint("    -runlog path\n")
+	consolePrint("                 append timestamped output of the whole session to file\n")
+	consolePrint("    -webhook url\n")
+	consolePrint("                 post JSON with number of processed and failed files, duration and hostname to url when finished\n")
+	consolePrint("    -timings path\n")
+	consolePrint("                 append input, outputs, duration, encoding time and average speed of each encoded file to CSV file\n")
+	consolePrint("    -emit-script path\n")
+	consolePrint("                 append escaped ffmpeg command of each run to shell script, .cmd or .bat path writes Windows batch file\n")
+	consolePrint("    -crop-out path\n")
+	consolePrint("                 append filename and recommended crop w,h,x,y of each input to CSV file in crop mode\n")
+	consolePrint("    -json-report path\n")
+	consolePrint("                 write JSON with ffmpeg command, status, encoding time and errors of each file to path when finished\n")
+	consolePrint("    -explain     print each preset and the arguments it expands to before running\n")
+	consolePrint("    -throttle ms print progress updates at most once per ms milliseconds, useful on slow terminals and over SSH\n")
+	consolePrint("    -bar         show \"[#####-----]\" progress bar after the percentage if it fits into the terminal width\n")
+	consolePrint("    -no-cr       print progress updates on separate lines once per second instead of overwriting them, useful with tee\n")
+	consolePrint("    -clean-on-fail\n")
+	consolePrint("                 remove outputs created by failed or interrupted ffmpeg run, existing files and inputs are kept\n")
+	consolePrint("    -overwrite   overwrite existing output files without asking, adds \"-y\" to ffmpeg command\n")
+	consolePrint("    -no-overwrite\n")
+	consolePrint("                 never overwrite existing output files, adds \"-n\" to ffmpeg command\n")
+	consolePrint("    -nice N      run ffmpeg with niceness N from -20 (highest priority) to 19 (lowest priority),\n")
+	consolePrint("                 on Windows positive values use below normal or idle priority class, negative ones above normal or high\n")
+	consolePrint("    -total-frames N\n")
+	consolePrint("                 number of input frames used for progress and ETA if duration is unknown, like in image sequences\n")
+	consolePrint("    -outdir path write batch outputs into directory instead of input directories, it is created if missing\n")
+	consolePrint("    -min-free size\n")
+	consolePrint("                 don't start encoding if output filesystem has less free space than size, e.g. 500M or 5G\n")
+	consolePrint("\n\x1b[33;1mEnvironment:\x1b[0m\n")
+	consolePrint("    FFLITE_FFMPEG    path to ffmpeg binary, \"ffmpeg\" from $PATH is used by default\n")
+	consolePrint("    FFLITE_FFPROBE   path to ffprobe binary, \"ffprobe\" from $PATH is used by default\n")
+	consolePrint("    FFLITE_ERROR_PATTERNS   newline-separated regexps of extra lines treated as errors\n")
+	consolePrint("    FFLITE_WARNING_PATTERNS newline-separated regexps of extra lines treated as warnings\n")
+	consolePrint("    FFLITE_BELL_OK   number of bells or shell command to run when the run is finished, 1 bell by default\n")
+	consolePrint("    FFLITE_BELL_FAIL number of bells or shell command to run when the run is finished with failures\n")
+	consolePrint("    FFLITE_NO_FFMPEG_CHECK\n")
+	consolePrint("                     don't warn if ffmpeg version is outside of the range fflite is tested with\n")
+	consolePrint("    FFLITE_NO_UPDATE_CHECK\n")
+	consolePrint("                     don't check the latest fflite version online, \"version\" prints only the local one\n")
+	consolePrint("    FFLITE_VERSION_CACHE_TTL\n")
+	consolePrint("                     how long the latest version check is cached (\"24h\" by default, \"0\" disables the cache), \"update\" always checks\n")
+	consolePrint("    NO_COLOR         disable colored output if set to a non-empty value\n")
 	consolePrint("\n\x1b[33;1mPresets:\x1b[0m\n")
-	// Find maximum length of preset keys.
+	// Find maximum length of preset names.
 	length := 0
 	for key := range presets {
-		if len(key[2:len(key)-1]) > length {
-			length = len(key[2 : len(key)-1])
+		if len(presetName(key)) > length {
+			length = len(presetName(key))
 		}
 	}
 	// Sort all presets alphabetically.
@@ -60,7 +156,11 @@ func help() {
 	sort.Strings(keys)
 	// Print out all presets.
 	for _, key := range keys {
-		consolePrint("    " + key[2:len(key)-1] + strings.Repeat(" ", length-len(key[2:len(key)-1])) + "    " + presets[key] + "\n")
+		source := ""
+		if userPresets[key] {
+			source = " \x1b[30;1m(config)\x1b[0m"
+		}
+		consolePrint("    " + presetName(key) + strings.Repeat(" ", length-len(presetName(key))) + "    " + presets[key] + source + "\n")
 	}
 	consolePrint("\n\x1b[33;1mFFmpeg documentation:\x1b[0m\n")
 	consolePrint("    www.ffmpeg.org/ffmpeg-all.html\n")
@@ -79,10 +179,9 @@ func contains(slice []string, s string) bool {
 }
 
 // scanLines is a split function for a Scanner that returns each line of text, stripped of any trailing end-of-line marker.
-// The end-of-line markers are: `\r?\n`, '\r', "[y/N]".
+// The end-of-line markers are: `\r?\n`, '\r', "[y/N]" and "(y/N)" prompts with optional trailing space.
 // The last non-empty line of input will be returned even if it has no newline.
 func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	const ynString = "[y/N] "
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
@@ -98,9 +197,9 @@ func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		// We have a full CR-terminated line.
 		return i + 1, dropCR(data[0:i]), nil
 	}
-	if i := strings.Index(string(data), ynString); i >= 0 {
-		// We have a full line ending with "[y/N]".
-		return i + len(ynString), data[0 : i+len(ynString)], nil
+	if loc := regexpMap["prompt"].FindIndex(data); loc != nil {
+		// We have a full line ending with "[y/N]" prompt.
+		return loc[1], data[0:loc[1]], nil
 	}
 	// If we're at EOF, we have a final, non-terminated line. Return it.
 	if atEOF {
@@ -119,8 +218,10 @@ func dropCR(data []byte) []byte {
 }
 
 // hhmmssmsToSeconds converts timecode (H:M:S.MS) to seconds float64 (S.MS).
+// Comma is accepted as a decimal separator (H:M:S,MS).
 func hhmmssmsToSeconds(hhmmssms string) float64 {
 	var hh, mm, ss, ms float64
+	hhmmssms = strings.Replace(hhmmssms, ",", ".", -1)
 	var buffer string
 	length := len(hhmmssms)
 	timecode := []string{}
@@ -169,56 +270,179 @@ func round(input float64) int64 {
 }
 
 // secondsToHHMMSS converts seconds (SS | SS.MS) to timecode (HH:MM:SS).
+// Seconds are rounded to the nearest integer before conversion, hours are not limited to two digits.
 func secondsToHHMMSS(seconds string) string {
 	s, _ := strconv.ParseFloat(seconds, 64)
-	hh := math.Floor(s / 3600)
-	mm := math.Floor((s - hh*3600) / 60)
-	ss := int64(math.Floor(s-hh*3600-mm*60)) + round(math.Remainder(s, 1.0))
-
-	hhString := strconv.FormatInt(int64(hh), 10)
-	mmString := strconv.FormatInt(int64(mm), 10)
-	ssString := strconv.FormatInt(int64(ss), 10)
-
-	if hh < 10 {
-		hhString = "0" + hhString
-	}
-	if mm < 10 {
-		mmString = "0" + mmString
-	}
-	if ss < 10 {
-		ssString = "0" + ssString
-	}
-	return hhString + ":" + mmString + ":" + ssString
+	if s < 0 || math.IsNaN(s) {
+		s = 0
+	}
+	// Avoid int64 overflow on huge values.
+	if s > 1e15 {
+		s = 1e15
+	}
+	total := int64(math.Round(s))
+	hh := total / 3600
+	mm := total / 60 % 60
+	ss := total % 60
+	return fmt.Sprintf("%02d:%02d:%02d", hh, mm, ss)
 }
 
 // getETA return remaining time for current file encoding based on average speed.
-func getETA(currentSpeed, duration, currentSecond float64, speedArray []float64) (string, []float64) {
-	speedArray = append(speedArray, currentSpeed)
-	if len(speedArray) >= 30 {
-		speedArray = speedArray[len(speedArray)-30 : len(speedArray)]
+// Average speed is computed over the last window samples.
+func getETA(currentSpeed, duration, currentSecond float64, speedArray []float64, window int) (string, []float64) {
+	// Unknown or bogus speed samples are not averaged.
+	if !math.IsNaN(currentSpeed) && !math.IsInf(currentSpeed, 0) && currentSpeed >= 0 {
+		speedArray = append(speedArray, currentSpeed)
+	}
+	if len(speedArray) >= window {
+		speedArray = speedArray[len(speedArray)-window : len(speedArray)]
 	}
 	var sum float64
 	for _, value := range speedArray {
 		sum += value
 	}
-	if sum == 0 {
+	if sum <= 0 {
 		return "N/A", speedArray
 	}
-	return strconv.FormatInt(round((duration-currentSecond)/(sum/float64(len(speedArray)))), 10), speedArray
+	remaining := duration - currentSecond
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strconv.FormatInt(round(remaining/(sum/float64(len(speedArray)))), 10), speedArray
+}
+
+// batchETA returns remaining time for the batch files with durations based on average batch encoding speed.
+// Files with unknown duration are excluded and the estimate is marked as approximate with "~".
+func batchETA(durations []float64, encoded float64, elapsed time.Duration) string {
+	if encoded <= 0 || elapsed <= 0 {
+		return "N/A"
+	}
+	var remaining float64
+	approximate := false
+	for _, d := range durations {
+		if d > 0 {
+			remaining += d
+		} else {
+			approximate = true
+		}
+	}
+	eta := secondsToHHMMSS(strconv.FormatFloat(remaining/(encoded/elapsed.Seconds()), 'f', -1, 64))
+	if approximate {
+		return "~" + eta
+	}
+	return eta
+}
+
+// printBatchSummary prints number of processed, succeeded, failed and skipped batch files and total time.
+func printBatchSummary(total, succeeded, failed, skipped int, elapsed time.Duration) {
+	consolePrint("\n\x1b[42;1mSUMMARY:\x1b[0m ", total, " files, \x1b[32;1m", succeeded, " succeeded\x1b[0m")
+	if failed > 0 {
+		consolePrint(", \x1b[31;1m", failed, " failed\x1b[0m")
+	} else {
+		consolePrint(", ", failed, " failed")
+	}
+	if skipped > 0 {
+		consolePrint(", \x1b[33;1m", skipped, " skipped\x1b[0m")
+	}
+	consolePrint(", et=" + secondsToHHMMSS(strconv.FormatFloat(elapsed.Seconds(), 'f', -1, 64)) + "\n")
 }
 
-// truncPad truncs or pads string to needed length.
+// truncPad truncs or pads string to needed display width.
+// ANSI escape sequences don't take any space and East Asian wide characters take two cells.
 // If side is 'r' the string is padded and aligned to the right side.
 // Otherwise it is aligned to the left side.
 func truncPad(s string, n int, side byte) string {
-	len := utf8.RuneCountInString(s)
-	if len > n {
-		return string([]rune(s)[0:n-3]) + "\x1b[30;1m...\x1b[0m"
+	width := displayWidth(s)
+	if width > n {
+		// Cut the string at the display column where truncation marker starts.
+		// There is no room for the marker in less than 3 columns.
+		limit, marker := n-3, "\x1b[30;1m...\x1b[0m"
+		if n < 3 {
+			limit, marker = n, ""
+		}
+		if limit < 0 {
+			limit = 0
+		}
+		cut, w := 0, 0
+		for cut < len(s) {
+			if loc := regexpMap["escape"].FindStringIndex(s[cut:]); loc != nil && loc[0] == 0 {
+				cut += loc[1]
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(s[cut:])
+			if w+runeWidth(r) > limit {
+				break
+			}
+			w += runeWidth(r)
+			cut += size
+		}
+		return s[:cut] + strings.Repeat(" ", limit-w) + marker
 	}
 	if side == 'r' {
-		return strings.Repeat(" ", n-len) + s
+		return strings.Repeat(" ", n-width) + s
+	}
+	return s + strings.Repeat(" ", n-width)
+}
+
+// displayWidth returns number of terminal cells taken by string without ANSI escape sequences.
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range regexpMap["escape"].ReplaceAllString(s, "") {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// wideRanges are East Asian Wide and Fullwidth unicode ranges.
+var wideRanges = []struct{ first, last rune }{
+	{0x1100, 0x115F},   // Hangul Jamo
+	{0x2E80, 0x303E},   // CJK Radicals, Kangxi, CJK Symbols and Punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, Bopomofo, Hangul Compatibility Jamo, CJK Compatibility
+	{0x3400, 0x4DBF},   // CJK Unified Ideographs Extension A
+	{0x4E00, 0x9FFF},   // CJK Unified Ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xA960, 0xA97F},   // Hangul Jamo Extended-A
+	{0xAC00, 0xD7A3},   // Hangul Syllables
+	{0xF900, 0xFAFF},   // CJK Compatibility Ideographs
+	{0xFE10, 0xFE19},   // Vertical Forms
+	{0xFE30, 0xFE6F},   // CJK Compatibility Forms, Small Form Variants
+	{0xFF00, 0xFF60},   // Fullwidth Forms
+	{0xFFE0, 0xFFE6},   // Fullwidth Signs
+	{0x1F300, 0x1F64F}, // Miscellaneous Symbols and Pictographs, Emoticons
+	{0x1F900, 0x1F9FF}, // Supplemental Symbols and Pictographs
+	{0x20000, 0x3FFFD}, // CJK Unified Ideographs Extension B and later
+}
+
+// runeWidth returns number of terminal cells taken by rune.
+func runeWidth(r rune) int {
+	if r == 0 || unicode.Is(unicode.Mn, r) || unicode.IsControl(r) {
+		return 0
+	}
+	for _, w := range wideRanges {
+		if r < w.first {
+			break
+		}
+		if r <= w.last {
+			return 2
+		}
+	}
+	return 1
+}
+
+// replaceFileName applies "[prefix?]old::new" pattern to name.
+// If old starts with "re:" it is used as a regexp and new can contain "$1" group references.
+// Prefix can't contain "?", so "?" in "re:" regexps is not taken for the prefix separator.
+func replaceFileName(pattern, name string) string {
+	match := regexpMap["fileNameReplace"].FindStringSubmatch(pattern)
+	if !strings.HasPrefix(match[2], "re:") {
+		return match[1] + strings.Replace(name, match[2], match[3], -1)
+	}
+	r, err := regexp.Compile(strings.TrimPrefix(match[2], "re:"))
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: invalid filename regexp \"" + match[2] + "\": " + err.Error() + "\x1b[0m\n")
+		os.Exit(1)
 	}
-	return s + strings.Repeat(" ", n-len)
+	return match[1] + r.ReplaceAllString(name, match[3])
 }
 
 // stringIndexInSlice returns the index of the first instance of str in slice,
@@ -232,36 +456,200 @@ func stringIndexInSlice(slice []string, str string) int {
 	return -1
 }
 
+// splitList splits "list:" filelist into file names.
+// Names are separated by spaces or tabs, double quoted parts may contain them.
+// Quote inside of the quoted part is escaped as \" or "", other backslashes are kept as is for Windows paths.
+func splitList(list string) ([]string, error) {
+	fields := []string{}
+	field := []rune{}
+	inField, quoted := false, false
+	runes := []rune(list)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quoted && r == '\\' && i+1 < len(runes) && runes[i+1] == '"':
+			field = append(field, '"')
+			i++
+		case quoted && r == '"' && i+1 < len(runes) && runes[i+1] == '"':
+			field = append(field, '"')
+			i++
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, string(field))
+				field = field[:0]
+				inField = false
+			}
+		default:
+			field = append(field, r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in list:%v", list)
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
+
 // sliceFromFileOrGlob returns slice of strings, each string is a line in input file if batchFile is true.
 // Otherwise input is read as a glob pattern.
 func sliceFromFileOrGlob(input string, batchFile bool) ([]string, error) {
+	// "list:-" reads the list of files from stdin the same way as from a file.
+	if input == "list:-" {
+		input, batchFile = "-", true
+	}
 	if batchFile {
-		return readLines(input)
+		lines, err := readLines(input)
+		if err != nil {
+			return nil, err
+		}
+		// Skip blank lines and comments starting with "#".
+		files := []string{}
+		for _, line := range lines {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			files = append(files, line)
+		}
+		return files, nil
 	}
 
 	if strings.HasPrefix(input, "list:") {
 		input = strings.Replace(input, "list:", "", 1)
-		input = strings.TrimSpace(input)
-		r := csv.NewReader(strings.NewReader(input))
-		r.Comma = ' '
-		fields, err := r.Read()
+		return splitList(input)
+	}
+
+	if strings.Contains(input, "**") {
+		return globRecursive(input)
+	}
+
+	return filepath.Glob(input)
+}
+
+// globRecursive returns files matching glob pattern where "**" matches any number of directories.
+func globRecursive(pattern string) ([]string, error) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	// Walk from the longest directory prefix without glob characters.
+	base := []string{}
+	for _, s := range segments {
+		if strings.ContainsAny(s, "*?[") {
+			break
+		}
+		base = append(base, s)
+	}
+	root := "."
+	if len(base) > 0 {
+		root = filepath.FromSlash(strings.Join(base, "/"))
+		if root == "" {
+			root = string(filepath.Separator)
+		}
+	}
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
 		if err != nil {
-			return []string{}, err
+			return err
+		}
+		ok, err := matchSegments(segments[len(base):], strings.Split(filepath.ToSlash(rel), "/"))
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// matchSegments reports whether path segments match pattern segments, "**" matches zero or more segments.
+func matchSegments(pattern, path []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if ok, err := matchSegments(pattern[1:], path[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(path) == 0 {
+			return false, nil
+		}
+		ok, err := filepath.Match(pattern[0], path[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0, nil
+}
+
+// naturalLess reports whether a sorts before b in natural order.
+// Digit sequences are compared by their numeric value, letters are compared case-insensitively.
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if isDigit(ra[i]) && isDigit(rb[j]) {
+			si, sj := i, j
+			for i < len(ra) && isDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && isDigit(rb[j]) {
+				j++
+			}
+			na := strings.TrimLeft(string(ra[si:i]), "0")
+			nb := strings.TrimLeft(string(rb[sj:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		if ra[i] != rb[j] {
+			return ra[i] < rb[j]
 		}
-		return fields, nil
+		i++
+		j++
 	}
+	if len(ra)-i != len(rb)-j {
+		return len(ra)-i < len(rb)-j
+	}
+	return a < b
+}
 
-	return filepath.Glob(input)
+// isDigit reports whether r is an ASCII digit.
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
 }
 
-// readLines reads a whole file into memory
+// readLines reads a whole file or stdin if path is "-" into memory
 // and returns a slice of its lines.
 func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
 	}
-	defer file.Close()
 
 	var lines []string
 	scanner := bufio.NewScanner(file)
@@ -272,8 +660,10 @@ func readLines(path string) ([]string, error) {
 }
 
 // consolePrint prints str to console while cursor is hidden.
+// Escapes are stripped if output is not a terminal or colors are disabled.
 func consolePrint(str ...interface{}) {
-	if !isTerminal {
+	writeRunLog(str...)
+	if !isTerminal || noColor {
 		for _, s := range str {
 			fmt.Print(stripEscapesFromString(fmt.Sprintf("%v", s)))
 		}
@@ -284,22 +674,335 @@ func consolePrint(str ...interface{}) {
 	ansi.CursorShow()
 }
 
+// showCursor shows cursor in case it was hidden by consolePrint.
+// Nothing is printed if output is not a terminal, so escape sequences don't get into piped output.
+func showCursor() {
+	if !isTerminal || noColor {
+		return
+	}
+	ansi.CursorShow()
+}
+
+// resetTerminal resets colors and shows cursor, so a crash doesn't leave the terminal in a bad state.
+func resetTerminal() {
+	if !isTerminal || noColor {
+		return
+	}
+	fmt.Print("\x1b[0m\n")
+	showCursor()
+}
+
+// writeRunLog appends escape-stripped text to the run log if it is enabled.
+// Progress updates ending with '\r' are skipped.
+func writeRunLog(str ...interface{}) {
+	if runLog == nil {
+		return
+	}
+	text := ""
+	for _, s := range str {
+		text += fmt.Sprintf("%v", s)
+	}
+	if strings.HasSuffix(text, "\r") {
+		return
+	}
+	runLog.WriteString(stripEscapesFromString(text))
+}
+
+// runLogHeader writes timestamped header to the run log and flushes it to disk.
+func runLogHeader(title string) {
+	if runLog == nil {
+		return
+	}
+	runLog.WriteString("\n[" + time.Now().Format("2006-01-02 15:04:05") + "] " + title + "\n")
+	runLog.Sync()
+}
+
+var stdinKeysOnce sync.Once
+var stdinKeysChan chan byte
+
+// stdinKeys returns channel of bytes read from stdin.
+// Reading is started once and shared by all encodes of a batch.
+func stdinKeys() <-chan byte {
+	stdinKeysOnce.Do(func() {
+		stdinKeysChan = make(chan byte)
+		go func() {
+			defer close(stdinKeysChan)
+			buf := make([]byte, 1)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if err != nil {
+					return
+				}
+				if n == 1 {
+					stdinKeysChan <- buf[0]
+				}
+			}
+		}()
+	})
+	return stdinKeysChan
+}
+
+// debugPrint prints raw ffmpeg line dimmed to stderr.
+func debugPrint(line string) {
+	if !isTerminal || noColor {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "\x1b[30;1m"+line+"\x1b[0m")
+}
+
 // bell rings bell send by typing bell ANSI code to terminal.
-func bell(mute bool) {
+// FFLITE_BELL_OK and FFLITE_BELL_FAIL environment variables set the number of bells
+// or a shell command to run instead when the run succeeded or failed, one bell is rung by default.
+func bell(mute bool, failed bool) {
 	if mute {
 		return
 	}
 	if !isTerminal {
 		return
 	}
-	consolePrint("\x07")
+	setting := os.Getenv("FFLITE_BELL_OK")
+	if failed {
+		setting = os.Getenv("FFLITE_BELL_FAIL")
+	}
+	setting = strings.TrimSpace(setting)
+	if setting == "" {
+		setting = "1"
+	}
+	count, err := strconv.Atoi(setting)
+	if err != nil {
+		if err := shellCommand(setting).Run(); err != nil {
+			consolePrint("\x1b[33;1mWARNING: bell command: " + err.Error() + "\x1b[0m\n")
+		}
+		return
+	}
+	for i := 0; i < count; i++ {
+		// Terminals merge bells sent at once, space them out.
+		if i > 0 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		consolePrint("\x07")
+	}
+}
+
+// shellCommand returns command that runs line in the system shell.
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
+
+// notify sends desktop notification using notify-send on Linux, osascript on macOS and PowerShell toast on Windows.
+// Errors are ignored.
+func notify(title, message string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", "display notification "+strconv.Quote(message)+" with title "+strconv.Quote(title))
+	case "windows":
+		quote := func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" }
+		script := "[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null;" +
+			"$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02);" +
+			"$text = $xml.GetElementsByTagName('text');" +
+			"$text.Item(0).AppendChild($xml.CreateTextNode(" + quote(title) + ")) > $null;" +
+			"$text.Item(1).AppendChild($xml.CreateTextNode(" + quote(message) + ")) > $null;" +
+			"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('fflite').Show([Windows.UI.Notifications.ToastNotification]::new($xml))"
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		cmd = exec.Command("notify-send", title, message)
+	}
+	cmd.Run()
+}
+
+// writeTimings appends CSV row with encoding time of input to the timings report at path.
+// Header row is written if the file is empty. Duration and speed are empty if duration is unknown.
+func writeTimings(path, input string, outputs []string, duration float64, elapsed time.Duration) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		return
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		w.Write([]string{"input", "output", "duration", "elapsed", "speed"})
+	}
+	row := []string{input, strings.Join(outputs, ";"), "", strconv.FormatFloat(elapsed.Seconds(), 'f', 2, 64), ""}
+	if duration > 0 {
+		row[2] = strconv.FormatFloat(duration, 'f', 2, 64)
+		row[4] = strconv.FormatFloat(duration/elapsed.Seconds(), 'f', 2, 64)
+	}
+	w.Write(row)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+	}
+}
+
+// writeCropRow appends CSV row with crop detected for input to the crop results file at path.
+// Header row is written if the file is empty. Crop values are empty if crop could not be detected.
+func writeCropRow(path, input string, c crop, ok bool) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		return
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		w.Write([]string{"filename", "w", "h", "x", "y"})
+	}
+	row := []string{input, "", "", "", ""}
+	if ok {
+		row = []string{input, strconv.Itoa(c.w), strconv.Itoa(c.h), strconv.Itoa(c.x), strconv.Itoa(c.y)}
+	}
+	w.Write(row)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+	}
+}
+
+// appendScript appends escaped ffmpeg command to the script file at path, so the run can be reproduced without fflite.
+// Windows batch file quoting is used if path has ".cmd" or ".bat" extension, POSIX shell quoting otherwise.
+// Header line is written if the file is empty.
+func appendScript(path, bin string, args []string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0775)
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		return
+	}
+	defer f.Close()
+	quote, header, eol := shellQuote, "#!/bin/sh\n", "\n"
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".cmd" || ext == ".bat" {
+		quote, header, eol = cmdQuote, "@echo off\r\n", "\r\n"
+	}
+	line := quote(bin)
+	for _, v := range args {
+		line += " " + quote(v)
+	}
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		line = header + line
+	}
+	if _, err := f.WriteString(line + eol); err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+	}
+}
+
+// shellQuote quotes argument for POSIX shell, arguments made of safe characters only are left as is.
+func shellQuote(s string) string {
+	if regexpMap["shellSafe"].MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// cmdQuote quotes argument for Windows batch file, percent signs are doubled so they are not expanded as variables.
+func cmdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if s != "" && !strings.ContainsAny(s, " \t&|<>^\"(),;=") {
+		return s
+	}
+	return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+}
+
+// webhookPayload is a JSON body posted to -webhook url when the run is finished.
+type webhookPayload struct {
+	Files      int     `json:"files"`
+	Succeeded  int     `json:"succeeded"`
+	Failed     int     `json:"failed"`
+	Skipped    int     `json:"skipped"`
+	Duration   float64 `json:"duration"`
+	Hostname   string  `json:"hostname"`
+	ExitStatus int     `json:"exit_status"`
+}
+
+// postWebhook posts payload as JSON to url.
+// It gives up after a short timeout and prints a warning on failure.
+func postWebhook(url string, payload webhookPayload) {
+	payload.Hostname, _ = os.Hostname()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		consolePrint("\x1b[33;1mWARNING: webhook: " + err.Error() + "\x1b[0m\n")
+		return
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		consolePrint("\x1b[33;1mWARNING: webhook: " + err.Error() + "\x1b[0m\n")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		consolePrint("\x1b[33;1mWARNING: webhook: " + url + " returned " + resp.Status + "\x1b[0m\n")
+	}
+}
+
+// reportItem describes one processed file in the -json-report document.
+type reportItem struct {
+	Input   string   `json:"input"`
+	Outputs []string `json:"outputs"`
+	Status  string   `json:"status"`
+	Elapsed float64  `json:"elapsed"`
+	Errors  []string `json:"errors"`
+}
+
+// runReport is a JSON document written to -json-report path when the run is finished.
+type runReport struct {
+	Command    []string     `json:"command"`
+	Items      []reportItem `json:"items"`
+	Files      int          `json:"files"`
+	Succeeded  int          `json:"succeeded"`
+	Failed     int          `json:"failed"`
+	Skipped    int          `json:"skipped"`
+	Duration   float64      `json:"duration"`
+	ExitStatus int          `json:"exit_status"`
+}
+
+// reportErrors strips escape sequences and line breaks from error lines.
+func reportErrors(errors []string) []string {
+	lines := []string{}
+	for _, v := range errors {
+		v = strings.TrimSpace(stripEscapesFromString(v))
+		if v != "" {
+			lines = append(lines, v)
+		}
+	}
+	return lines
+}
+
+// writeJSONReport writes report as indented JSON to path, replacing the previous one.
+func writeJSONReport(path string, report runReport) {
+	for _, v := range report.Items {
+		report.Files++
+		switch v.Status {
+		case "ok":
+			report.Succeeded++
+		case "failed":
+			report.Failed++
+		case "skipped":
+			report.Skipped++
+		}
+	}
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		consolePrint("\x1b[33;1mWARNING: json report: " + err.Error() + "\x1b[0m\n")
+		return
+	}
+	if err := ioutil.WriteFile(path, append(body, '\n'), 0664); err != nil {
+		consolePrint("\x1b[33;1mWARNING: json report: " + err.Error() + "\x1b[0m\n")
+	}
 }
 
 // isWarningSpamming checks if warning message comes up too often and omits it if needed.
-func isWarningSpamming(array []string, str string, spamList map[string]bool) bool {
+// Limit of 0 disables omitting.
+func isWarningSpamming(array []string, str string, spamList map[string]bool, limit int) bool {
+	if limit == 0 {
+		return false
+	}
 	if !spamList[str] {
 		count := 0
-		limit := 10
 		for _, v := range array {
 			if v == str {
 				count++
@@ -307,7 +1010,7 @@ func isWarningSpamming(array []string, str string, spamList map[string]bool) boo
 		}
 		if count >= limit {
 			spamList[str] = true
-			consolePrint("\n     \x1b[33;1mOmitting further warnings: \x1b[33m" + str + "\x1b[0m\n")
+			consolePrint("\n     \x1b[33;1mOmitting further warnings after " + strconv.Itoa(limit) + " repeats: \x1b[33m" + str + "\x1b[0m\n")
 			return true
 		}
 		return false
@@ -324,7 +1027,11 @@ func parseOutput(line string) string {
 }
 
 func parseDuration(line string) (string, float64) {
-	duration := hhmmssmsToSeconds(regexpMap["durationHHMMSSMS"].ReplaceAllString(line, "${1}"))
+	// Duration is "N/A" for pipes and live streams.
+	duration := 0.0
+	if m := regexpMap["durationHHMMSSMS"].FindStringSubmatch(line); m != nil {
+		duration = hhmmssmsToSeconds(m[1])
+	}
 	line = regexpMap["duration"].ReplaceAllString(line, "  ${1}\n")
 	return line, duration
 }
@@ -337,18 +1044,36 @@ func parseStream(line string) string {
 	return regexpMap["stream"].ReplaceAllString(line, "    \x1b[36;1m${1}\x1b[0m \x1b[30;1m${2}\x1b[0m ${3}\n")
 }
 
+// streamHandler appends handler name from handler line to the stream line printed by parseStream.
+func streamHandler(stream, line string) string {
+	handler := strings.TrimSpace(regexpMap["handler"].ReplaceAllString(line, "${1}"))
+	return strings.TrimSuffix(stream, "\n") + " \x1b[30;1m(" + handler + ")\x1b[0m\n"
+}
+
 func parseHandler(line string) string {
 	handler := regexpMap["handler"].ReplaceAllString(line, "${1}")
 
-	if contains(hideHandlers, handler) {
+	if hiddenHandler(handler) {
 		line = ""
 	} else {
-		line += "\n"
+		line = "\x1b[30;1m" + line + "\x1b[0m\n"
 	}
 
 	return line
 }
 
+// hiddenHandler reports whether handler name matches any of hideHandlers.
+// Entries can contain "*" and "?" wildcards, "Apple * Handler" hides all Apple handlers.
+func hiddenHandler(handler string) bool {
+	handler = strings.TrimSpace(handler)
+	for _, v := range hideHandlers {
+		if ok, _ := filepath.Match(v, handler); ok || strings.EqualFold(v, handler) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseErrors(line string, lastLineFull string, batchMode bool, errorsArray []string) (string, []string) {
 	if (lastLineFull != "") && (lastLineFull[len(lastLineFull)-1]) == '\r' {
 		consolePrint("\n")
@@ -360,9 +1085,9 @@ func parseErrors(line string, lastLineFull string, batchMode bool, errorsArray [
 	return line, errorsArray
 }
 
-func parseWarnings(line string, lastLineFull string, warningArray []string, warningSpam map[string]bool) (string, []string) {
+func parseWarnings(line string, lastLineFull string, warningArray []string, warningSpam map[string]bool, warnLimit int) (string, []string) {
 	line = strings.TrimSpace(regexpMap["warnings"].ReplaceAllString(line, "${1}"))
-	if isWarningSpamming(warningArray, line, warningSpam) {
+	if isWarningSpamming(warningArray, line, warningSpam, warnLimit) {
 		line = ""
 		return line, warningArray
 	}
@@ -374,65 +1099,498 @@ func parseWarnings(line string, lastLineFull string, warningArray []string, warn
 	return line, warningArray
 }
 
-func parseEncoding(line string, lastLineFull string, duration float64, speedArray []float64) (string, string, string, []float64) {
-	timeSpeed := strings.Split(regexpMap["timeSpeed"].ReplaceAllString(line, "$1 $2"), " ")
-	currentSecond := hhmmssmsToSeconds(timeSpeed[0])
-	currentSpeed, _ := strconv.ParseFloat(timeSpeed[1], 64)
-	progress := "N\\A"
-	eta := "N\\A"
-	line = strings.TrimSpace(regexpMap["encoding"].ReplaceAllString(line, "${1} ${2} ${4} \x1b[33;1m${3}\x1b[0m"))
-	if strings.Contains(line, "dup=0 ") {
-		line = strings.Replace(line, "dup=0 ", "", -1)
+// ffmpegLine is a line of ffmpeg output.
+// Lines built from -progress output carry the parsed values, so they are not re-parsed from the text.
+type ffmpegLine struct {
+	text     string
+	progress *progressValues
+}
+
+// progressValues holds ffmpeg -progress values used for percentage, ETA and stats.
+type progressValues struct {
+	seconds float64
+	speed   float64 // NaN if unknown.
+	bitrate string
+}
+
+// readProgress reads key=value blocks of ffmpeg -progress output from r
+// and sends each block to lines as a status line in ffmpeg stats format along with its values.
+func readProgress(r io.Reader, lines chan<- ffmpegLine) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if key != "progress" {
+			values[key] = value
+			continue
+		}
+		// Final status line comes from stderr when progress ends.
+		if value == "continue" {
+			lines <- ffmpegLine{progressLine(values), parseProgressValues(values)}
+		}
+		values = map[string]string{}
+	}
+}
+
+// progressLine converts ffmpeg -progress values into ffmpeg stats line.
+func progressLine(values map[string]string) string {
+	cs := int64(parseProgressValues(values).seconds*1e6+0.5) / 10000
+	timecode := fmt.Sprintf("%02d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+	size, _ := strconv.ParseInt(values["total_size"], 10, 64)
+	line := "frame=" + values["frame"] + " fps=" + values["fps"] + " size=" + strconv.FormatInt(size/1024, 10) + "kB time=" + timecode + " bitrate=" + values["bitrate"]
+	if values["dup_frames"] != "" && values["dup_frames"] != "0" {
+		line += " dup=" + values["dup_frames"]
+	}
+	if values["drop_frames"] != "" && values["drop_frames"] != "0" {
+		line += " drop=" + values["drop_frames"]
+	}
+	return line + " speed=" + values["speed"]
+}
+
+// parseProgressValues returns time, speed and bitrate from ffmpeg -progress values.
+func parseProgressValues(values map[string]string) *progressValues {
+	// out_time_ms is in microseconds despite its name, out_time_us is used by newer ffmpeg versions.
+	us, err := strconv.ParseInt(values["out_time_us"], 10, 64)
+	if err != nil {
+		us, _ = strconv.ParseInt(values["out_time_ms"], 10, 64)
+	}
+	if us < 0 {
+		us = 0
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(values["speed"]), "x"), 64)
+	if err != nil {
+		speed = math.NaN()
+	}
+	return &progressValues{float64(us) / 1e6, speed, values["bitrate"]}
+}
+
+// progressStats is a machine-readable representation of a progress line.
+type progressStats struct {
+	Time    string  `json:"time"`
+	Speed   float64 `json:"speed"`
+	Percent float64 `json:"percent"`
+	ETA     string  `json:"eta"`
+	Bitrate string  `json:"bitrate"`
+}
+
+// writeProgressJSON writes stats as a single JSON line to f if it is not nil.
+func writeProgressJSON(f *os.File, stats progressStats) {
+	if f == nil {
+		return
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return
 	}
-	if strings.Contains(line, "drop=0 ") {
-		line = strings.Replace(line, "drop=0 ", "", -1)
+	f.Write(append(b, '\n'))
+}
+
+// parseEncoding parses ffmpeg stats line.
+// If pv is not nil, line is built from -progress output and time, speed and bitrate are taken from pv instead.
+func parseEncoding(line string, lastLineFull string, duration, totalFrames float64, startTime time.Time, pv *progressValues, speedArray []float64, etaWindow int, decimalPercent bool) (string, string, string, []float64, progressStats) {
+	rawLine := line
+	var currentSecond, currentSpeed float64
+	var stats progressStats
+	if pv != nil {
+		currentSecond, currentSpeed = pv.seconds, pv.speed
+		speed := "N/A"
+		stats = progressStats{Time: regexpMap["currentSecond"].ReplaceAllString(line, "$1"), ETA: "N/A", Bitrate: pv.bitrate}
+		if !math.IsNaN(currentSpeed) {
+			stats.Speed = currentSpeed
+			speed = strconv.FormatFloat(currentSpeed, 'f', -1, 64) + "x"
+		}
+		line = "time=" + stats.Time + " bitrate=" + pv.bitrate + " speed=" + speed + frameStats(rawLine)
+	} else {
+		timeSpeed := strings.Split(regexpMap["timeSpeed"].ReplaceAllString(line, "$1 $2"), " ")
+		currentSecond = hhmmssmsToSeconds(timeSpeed[0])
+		currentSpeed, _ = strconv.ParseFloat(timeSpeed[1], 64)
+		stats = progressStats{Time: timeSpeed[0], Speed: currentSpeed, ETA: "N/A", Bitrate: strings.TrimPrefix(regexpMap["encoding"].ReplaceAllString(line, "${2}"), "bitrate=")}
+		line = strings.TrimSpace(regexpMap["encoding"].ReplaceAllString(line, "${1} ${2} ${3}")) + frameStats(rawLine)
 	}
+	progress := "N\\A"
+	eta := "N\\A"
 	lastLine := line
 	if duration > 0 {
-		progress = truncPad(strconv.FormatInt(int64(currentSecond/(duration/100.0)), 10), 3, 'r')
-		eta, speedArray = getETA(currentSpeed, duration, currentSecond, speedArray)
-		eta = secondsToHHMMSS(eta)
-		line = "\x1b[33;1m" + progress + "%\x1b[0m eta=" + eta + " " + line
+		progress = formatPercent(currentSecond/(duration/100.0), decimalPercent)
+		eta, speedArray = getETA(currentSpeed, duration, currentSecond, speedArray, etaWindow)
+		if eta != "N/A" {
+			eta = secondsToHHMMSS(eta)
+		}
+		stats.Percent = currentSecond / (duration / 100.0)
+		line = percentLine(progress, stats.Percent, "eta="+eta+estimateSize(rawLine, stats.Percent)+" "+line)
+		stats.ETA = eta
+	} else if totalFrames > 0 {
+		progress, eta, stats.Percent, speedArray = frameProgress(rawLine, totalFrames, speedArray, etaWindow, decimalPercent)
+		line = percentLine(progress, stats.Percent, "eta="+eta+" "+line)
+		stats.ETA = eta
 	} else {
-		line = "\x1b[33;1m" + progress + "\x1b[0m " + line
+		line = streamProgress(line, startTime)
 	}
-	if (len(lastLineFull) > 0) && (lastLineFull[len(lastLineFull)-1] == '\r') && (len(line) < len(strings.TrimSpace(lastLineFull))) {
-		line += strings.Repeat(" ", len(strings.TrimSpace(lastLineFull))-len(line))
+	if progressNewline {
+		return line + "\n", lastLine, progress, speedArray, stats
 	}
-	line += "\r"
-	return line, lastLine, progress, speedArray
+	return fitProgress(line, lastLineFull), lastLine, progress, speedArray, stats
 }
 
-func parseEncodingNoSpeed(line string, lastLineFull string, duration float64, startTime time.Time, prevUptime time.Duration, prevSecond float64, speedArray []float64) (string, string, string, []float64) {
-	currentSecond := hhmmssmsToSeconds(regexpMap["currentSecond"].ReplaceAllString(line, "$1"))
+// parseEncodingNoSpeed parses stats line without "speed=", like the ones printed with -loglevel error -stats.
+// Speed is computed from the progress since the previous sample at prevUptime and prevSecond, which are updated with the current ones.
+func parseEncodingNoSpeed(line string, lastLineFull string, duration, totalFrames float64, startTime time.Time, prevUptime *time.Duration, prevSecond *float64, speedArray []float64, etaWindow int, decimalPercent bool) (string, string, string, []float64, progressStats) {
+	rawLine := line
+	currentTime := regexpMap["currentSecond"].ReplaceAllString(line, "$1")
+	currentSecond := hhmmssmsToSeconds(currentTime)
 	currentUptime := time.Since(startTime)
-	currentSpeed := 0.0
-	if currentUptime-prevUptime > 0 {
-		currentSpeed = (currentSecond - prevSecond) / (currentUptime - prevUptime).Seconds()
+	// Speed is unknown until the encoding time advances since the previous sample.
+	currentSpeed := math.NaN()
+	speed := "N/A"
+	if currentUptime > *prevUptime && currentSecond > *prevSecond {
+		currentSpeed = (currentSecond - *prevSecond) / (currentUptime - *prevUptime).Seconds()
+		speed = strconv.FormatFloat(currentSpeed, 'f', 2, 64) + "x"
+		*prevUptime = currentUptime
+		*prevSecond = currentSecond
+	} else if len(speedArray) > 0 {
+		// Show the last known speed, but don't count it again for ETA.
+		speed = strconv.FormatFloat(speedArray[len(speedArray)-1], 'f', 2, 64) + "x"
 	}
 	progress := "N\\A"
 	eta := "N\\A"
-	line = strings.TrimSpace(regexpMap["encodingNoSpeed"].ReplaceAllString(line, "${1} ${3} speed="+strconv.FormatFloat(currentSpeed, 'f', 2, 64)+"x \x1b[33;1m${3}\x1b[0m"))
-	if strings.Contains(line, "dup=0 ") {
-		line = strings.Replace(line, "dup=0 ", "", -1)
-	}
-	if strings.Contains(line, "drop=0 ") {
-		line = strings.Replace(line, "drop=0 ", "", -1)
+	stats := progressStats{Time: currentTime, ETA: "N/A", Bitrate: strings.TrimPrefix(regexpMap["encodingNoSpeed"].ReplaceAllString(line, "${2}"), "bitrate=")}
+	if !math.IsNaN(currentSpeed) {
+		stats.Speed = currentSpeed
 	}
+	line = strings.TrimSpace(regexpMap["encodingNoSpeed"].ReplaceAllString(line, "${1} ${2} speed="+speed)) + frameStats(rawLine)
 	lastLine := line
 	if duration > 0 {
-		progress := truncPad(strconv.FormatInt(int64(currentSecond/(duration/100.0)), 10), 3, 'r')
-		eta, speedArray = getETA(currentSpeed, duration, currentSecond, speedArray)
-		eta = secondsToHHMMSS(eta)
-		line = "\x1b[33;1m" + progress + "%\x1b[0m eta=" + eta + " " + line
+		progress = formatPercent(currentSecond/(duration/100.0), decimalPercent)
+		eta, speedArray = getETA(currentSpeed, duration, currentSecond, speedArray, etaWindow)
+		if eta != "N/A" {
+			eta = secondsToHHMMSS(eta)
+		}
+		stats.Percent = currentSecond / (duration / 100.0)
+		line = percentLine(progress, stats.Percent, "eta="+eta+estimateSize(rawLine, stats.Percent)+" "+line)
+		stats.ETA = eta
+	} else if totalFrames > 0 {
+		progress, eta, stats.Percent, speedArray = frameProgress(rawLine, totalFrames, speedArray, etaWindow, decimalPercent)
+		line = percentLine(progress, stats.Percent, "eta="+eta+" "+line)
+		stats.ETA = eta
 	} else {
-		line = "\x1b[33;1m" + progress + "\x1b[0m " + line + " speed=" + strconv.FormatFloat(currentSpeed, 'f', 2, 64) + "x"
+		line = streamProgress(line, startTime)
 	}
-	if (len(lastLineFull) > 0) && (lastLineFull[len(lastLineFull)-1] == '\r') && (len(line) < len(strings.TrimSpace(lastLineFull))) {
-		line += strings.Repeat(" ", len(strings.TrimSpace(lastLineFull))-len(line))
+	if progressNewline {
+		return line + "\n", lastLine, progress, speedArray, stats
 	}
-	line += "\r"
-	return line, lastLine, progress, speedArray
+	return fitProgress(line, lastLineFull), lastLine, progress, speedArray, stats
+}
+
+// Progress bar width limits, the bar fills the room left on the terminal line up to barMaxWidth.
+const (
+	barMinWidth = 10
+	barMaxWidth = 50
+)
+
+// percentLine returns progress line with percentage followed by the rest of the line.
+// With -bar option "[#####-----]" bar is put between them if there is room for it on the terminal.
+func percentLine(progress string, percent float64, rest string) string {
+	head := "\x1b[33;1m" + progress + "%\x1b[0m "
+	if !progressBar {
+		return head + rest
+	}
+	size := barMaxWidth
+	if width := int(atomic.LoadInt32(&termWidth)) - 1; width > 0 && width-displayWidth(head+rest)-3 < size {
+		size = width - displayWidth(head+rest) - 3
+	}
+	// Narrow terminal, show only the percentage.
+	if size < barMinWidth {
+		return head + rest
+	}
+	filled := int(percent / 100 * float64(size))
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > size {
+		filled = size
+	}
+	return head + "[" + strings.Repeat("#", filled) + strings.Repeat("-", size-filled) + "] " + rest
+}
+
+// streamProgress prefixes progress line with elapsed time if duration of the input is unknown,
+// like in pipes and live streams, where percentage and ETA can't be computed.
+func streamProgress(line string, startTime time.Time) string {
+	return "\x1b[33;1mstream\x1b[0m et=" + secondsToHHMMSS(strconv.FormatFloat(time.Since(startTime).Seconds(), 'f', -1, 64)) + " " + line
+}
+
+// formatPercent returns progress percentage right-aligned in a fixed width column.
+// If decimal is true it is rounded down to one decimal place, to whole number otherwise.
+func formatPercent(percent float64, decimal bool) string {
+	if decimal {
+		return truncPad(strconv.FormatFloat(math.Floor(percent*10)/10, 'f', 1, 64), 5, 'r')
+	}
+	return truncPad(strconv.FormatInt(int64(percent), 10), 3, 'r')
+}
+
+// estimateSize returns estimated final output size based on current size and progress percentage
+// formatted as " est=~1.2GiB", or empty string if it can't be estimated.
+func estimateSize(line string, percent float64) string {
+	size := outputSize(line)
+	if size <= 0 || percent <= 0 {
+		return ""
+	}
+	return " est=~" + formatBytes(size*100/percent)
+}
+
+// outputSize returns output size in bytes from ffmpeg stats line, or 0 if it is not found.
+func outputSize(line string) float64 {
+	m := regexpMap["size"].FindStringSubmatch(line)
+	if m == nil {
+		return 0
+	}
+	size, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0
+	}
+	switch strings.ToLower(m[2]) {
+	case "mb", "mib":
+		size *= 1024 * 1024
+	case "gb", "gib":
+		size *= 1024 * 1024 * 1024
+	default:
+		size *= 1024
+	}
+	return size
+}
+
+// statsTrailer returns grep-friendly "FFLITE_STATS" line with encoding time in seconds,
+// average speed, number of frames and output size in bytes from the last ffmpeg stats line.
+func statsTrailer(line string, elapsed time.Duration) string {
+	speed := 0.0
+	if m := regexpMap["currentSecond"].FindStringSubmatch(line); m != nil && elapsed > 0 {
+		speed = hhmmssmsToSeconds(m[1]) / elapsed.Seconds()
+	}
+	frames := "0"
+	if m := regexpMap["frame"].FindStringSubmatch(line); m != nil {
+		frames = m[1]
+	}
+	return "FFLITE_STATS elapsed=" + strconv.FormatFloat(elapsed.Seconds(), 'f', 2, 64) +
+		" speed=" + strconv.FormatFloat(speed, 'f', 2, 64) +
+		" frames=" + frames +
+		" size=" + strconv.FormatFloat(outputSize(line), 'f', 0, 64) + "\n"
+}
+
+// formatBytes formats number of bytes into human readable string using binary prefixes.
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatFloat(b, 'f', 0, 64) + units[i]
+	}
+	return strconv.FormatFloat(b, 'f', 1, 64) + units[i]
+}
+
+// parseSize parses size with optional K, M, G or T binary suffix into bytes.
+func parseSize(s string) (uint64, error) {
+	multiplier := 1.0
+	upper := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if upper != "" {
+		if i := strings.IndexByte("KMGT", upper[len(upper)-1]); i >= 0 {
+			multiplier = math.Pow(1024, float64(i+1))
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(n * multiplier), nil
+}
+
+// checkFreeSpace returns an error if filesystem of any output has less than min bytes available.
+// URLs, pipes and null sinks are ignored.
+func checkFreeSpace(outputs []string, min uint64) error {
+	for _, output := range outputs {
+		if strings.Contains(output, "://") || strings.HasPrefix(output, "pipe:") || output == "-" || isNullSink(output) {
+			continue
+		}
+		dir, err := filepath.Abs(filepath.Dir(output))
+		if err != nil {
+			return err
+		}
+		// Output directory may not exist yet, check the closest existing parent.
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		free, err := diskFree(dir)
+		if err != nil {
+			return err
+		}
+		if free < min {
+			return fmt.Errorf("not enough free space in \"%v\": %v requested, %v available", dir, formatBytes(float64(min)), formatBytes(float64(free)))
+		}
+	}
+	return nil
+}
+
+// updateTermWidth queries the number of terminal columns, 80 is used if it is unknown.
+// Width is not limited if output is not a terminal.
+func updateTermWidth() {
+	if !isTerminal {
+		atomic.StoreInt32(&termWidth, 0)
+		return
+	}
+	width, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	atomic.StoreInt32(&termWidth, int32(width))
+}
+
+// fitBannerName truncates filename to the room left on the terminal line after used columns of the batch banner.
+// Long names are cut to 20 columns at least, the name is not truncated if output is not a terminal.
+func fitBannerName(name string, used int) string {
+	updateTermWidth()
+	width := int(atomic.LoadInt32(&termWidth)) - 1
+	if width <= 0 || used+displayWidth(name) <= width {
+		return name
+	}
+	room := width - used
+	if room < 20 {
+		room = 20
+	}
+	return truncPad(name, room, 'l')
+}
+
+// fitProgress truncates progress line to the terminal width, so it doesn't wrap,
+// and pads it to erase the rest of the previous progress line.
+func fitProgress(line, lastLineFull string) string {
+	width := int(atomic.LoadInt32(&termWidth)) - 1
+	if width > 0 && displayWidth(line) > width {
+		line = truncPad(line, width, 'l')
+	}
+	if (len(lastLineFull) > 0) && (lastLineFull[len(lastLineFull)-1] == '\r') {
+		if prev := displayWidth(strings.TrimSpace(lastLineFull)); prev > displayWidth(line) {
+			line += strings.Repeat(" ", prev-displayWidth(line))
+		}
+	}
+	return line + "\r"
+}
+
+// frameProgress returns progress percentage and ETA based on the frame number and fps of the status line.
+func frameProgress(line string, totalFrames float64, speedArray []float64, etaWindow int, decimalPercent bool) (string, string, float64, []float64) {
+	var currentFrame, fps float64
+	if m := regexpMap["frame"].FindStringSubmatch(line); m != nil {
+		currentFrame, _ = strconv.ParseFloat(m[1], 64)
+	}
+	if m := regexpMap["fps"].FindStringSubmatch(line); m != nil {
+		fps, _ = strconv.ParseFloat(m[1], 64)
+	}
+	percent := currentFrame / (totalFrames / 100.0)
+	progress := formatPercent(percent, decimalPercent)
+	eta, speedArray := getETA(fps, totalFrames, currentFrame, speedArray, etaWindow)
+	if eta != "N/A" {
+		eta = secondsToHHMMSS(eta)
+	}
+	return progress, eta, percent, speedArray
+}
+
+// frameStats returns fps and non-zero dup and drop counters of ffmpeg stats line
+// as a separate progress line segment, dropped frames are shown in red.
+func frameStats(line string) string {
+	stats := ""
+	if m := regexpMap["fps"].FindStringSubmatch(line); m != nil {
+		stats += " fps=" + m[1]
+	}
+	if m := regexpMap["dup"].FindStringSubmatch(line); m != nil && m[1] != "0" {
+		stats += " \x1b[33;1mdup=" + m[1] + "\x1b[0m"
+	}
+	if m := regexpMap["drop"].FindStringSubmatch(line); m != nil && m[1] != "0" {
+		stats += " \x1b[31;1mdrop=" + m[1] + "\x1b[0m"
+	}
+	return stats
+}
+
+// progressDue reports if progress update should be printed, the previous one
+// being printed at lastPrinted. Updates are printed at most once per interval.
+func progressDue(lastPrinted *time.Time, interval time.Duration) bool {
+	if interval <= 0 {
+		return true
+	}
+	if time.Since(*lastPrinted) < interval {
+		return false
+	}
+	*lastPrinted = time.Now()
+	return true
+}
+
+// sequenceFrames returns number of files matching image sequence pattern like "img%04d.png" or 0 if input is not a sequence.
+func sequenceFrames(input string) float64 {
+	base := filepath.Base(input)
+	m := regexpMap["sequence"].FindStringSubmatchIndex(base)
+	if m == nil {
+		return 0
+	}
+	// "%04d" is a zero-padded number of 4 digits, "%d" is a number of any length.
+	digits := `\d+`
+	if m[2] != -1 && strings.TrimLeft(base[m[2]:m[3]], "0") != "" {
+		digits = `\d{` + strings.TrimLeft(base[m[2]:m[3]], "0") + `}`
+	}
+	r, err := regexp.Compile("^" + regexp.QuoteMeta(base[:m[0]]) + digits + regexp.QuoteMeta(base[m[1]:]) + "$")
+	if err != nil {
+		return 0
+	}
+	entries, err := os.ReadDir(filepath.Dir(input))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() && r.MatchString(e.Name()) {
+			count++
+		}
+	}
+	return float64(count)
+}
+
+// inputFramerate returns "-framerate" or "-r" value set before the first input, 25 by default as in image2 demuxer.
+func inputFramerate(ffCommand []string) float64 {
+	for i := 0; i+1 < len(ffCommand); i++ {
+		if ffCommand[i] == "-i" {
+			break
+		}
+		if ffCommand[i] == "-framerate" || ffCommand[i] == "-r" {
+			if fraction := strings.SplitN(ffCommand[i+1], "/", 2); len(fraction) == 2 {
+				num, err1 := strconv.ParseFloat(fraction[0], 64)
+				den, err2 := strconv.ParseFloat(fraction[1], 64)
+				if err1 == nil && err2 == nil && num > 0 && den > 0 {
+					return num / den
+				}
+			} else if fps, err := strconv.ParseFloat(ffCommand[i+1], 64); err == nil && fps > 0 {
+				return fps
+			}
+		}
+	}
+	return 25
+}
+
+// probeFrames returns number of frames in the first video stream of the input file using ffprobe or 0 if it is unknown.
+func probeFrames(input string) float64 {
+	out, err := exec.Command(ffprobeBin, "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=nb_frames", "-of", "csv=p=0", input).Output()
+	if err != nil {
+		return 0
+	}
+	frames, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0
+	}
+	return frames
 }
 
 func parseEncodingErrors(line string, lastLineFull string, lastLineUsed string, lastLine string, errorsArray []string, progress string) (string, string, []string) {
@@ -450,7 +1608,9 @@ func parseEncodingErrors(line string, lastLineFull string, lastLineUsed string,
 }
 
 func parseFinish(line string, sigint bool, progress string, lastLine string, startTime time.Time) (bool, bool) {
-	consolePrint(strings.Repeat(" ", len(line)) + "\r")
+	if !progressNewline {
+		consolePrint(strings.Repeat(" ", len(line)) + "\r")
+	}
 	if sigint {
 		consolePrint("\x1b[31;1m" + progress + "%\x1b[0m " + lastLine + "\n")
 		consolePrint("\x1b[31;1mSIGINT\x1b[0m\n")
@@ -462,11 +1622,16 @@ func parseFinish(line string, sigint bool, progress string, lastLine string, sta
 	return encodingStarted, encodingFinished
 }
 
+// stripEscapesFromString removes ANSI CSI sequences from str,
+// colors as well as cursor movement and visibility sequences.
 func stripEscapesFromString(str string) string {
-	return regexp.MustCompile(`(\x1b\[\d+(;\d+)*m)`).ReplaceAllString(str, "")
+	return regexpMap["escape"].ReplaceAllString(str, "")
 }
 
 func writeStringArrayToFile(filename string, strArray []string, perm os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0775); err != nil {
+		log.Panic(err)
+	}
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
 	if err != nil {
 		log.Panic(err)
@@ -479,6 +1644,245 @@ func writeStringArrayToFile(filename string, strArray []string, perm os.FileMode
 	}
 }
 
+// prepareOutDir creates output directory if it is missing and checks that it is writable.
+func prepareOutDir(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return fmt.Errorf("can't create output directory: %v", err)
+	}
+	f, err := ioutil.TempFile(dir, ".fflite")
+	if err != nil {
+		return fmt.Errorf("output directory %q is not writable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// logPath returns error log filename for input using template.
+// {dir} is the input directory or current work directory with cwdlogs, {base} is the input filename
+// without extension, {ext} is the input extension and {date} is the current date and time.
+func logPath(input, template, cwd string, cwdlogs bool) string {
+	if template == "" {
+		template = "{dir}/{base}{ext}.#err"
+	}
+	dir := filepath.Dir(input)
+	if cwdlogs {
+		dir = cwd
+	}
+	ext := filepath.Ext(input)
+	r := strings.NewReplacer(
+		"{dir}", dir,
+		"{base}", strings.TrimSuffix(filepath.Base(input), ext),
+		"{ext}", ext,
+		"{date}", time.Now().Format("2006-01-02_15-04-05"),
+	)
+	return filepath.Clean(r.Replace(template))
+}
+
+// presetsConfigPath returns the path of the custom presets config file.
+func presetsConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fflite", "presets.json")
+}
+
+// completionOptions are fflite options offered by shell completion.
+var completionOptions = []string{"ffmpeg", "banner", "nologs", "cwdlogs", "crop", "autocrop", "sync", "mute", "skipexisting", "dryrun", "nocolor",
+	"progresspipe", "quiet", "debug", "notify", "pause", "decimalpercent", "failfast", "natsort", "concat", "multiin", "statsline", "handlers",
+	"hwcheck", "version", "version-json", "presets-json", "update", "completion",
+	"-explain", "-bar", "-no-cr", "-clean-on-fail", "-eta-window", "-warn-limit", "-retries", "-stall-timeout", "-throttle", "-sync-format", "-progress-json", "-logname",
+	"-runlog", "-webhook", "-timings", "-crop-out", "-emit-script", "-json-report", "-overwrite", "-no-overwrite", "-nice", "-total-frames", "-outdir", "-min-free"}
+
+// completionWords returns fflite options and preset names for shell completion.
+// Presets with parameters are completed up to the first parameter, "@crf(\d+)" becomes "@crf".
+func completionWords() []string {
+	words := append([]string{}, completionOptions...)
+	seen := map[string]bool{}
+	names := []string{}
+	for key := range presets {
+		name := strings.Replace(strings.TrimPrefix(key, "^"), `\@`, "@", 1)
+		if n := strings.IndexAny(name, `()[]\.*+?{}|$`); n != -1 {
+			name = name[:n]
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append(words, names...)
+}
+
+// completionScript returns completion script of fflite options and presets for shell.
+func completionScript(shell string) (string, error) {
+	words := strings.Join(completionWords(), " ")
+	switch shell {
+	case "bash":
+		return "_fflite() {\n" +
+			"    COMPREPLY=($(compgen -W \"" + words + "\" -- \"${COMP_WORDS[COMP_CWORD]}\"))\n" +
+			"}\n" +
+			"complete -o default -F _fflite fflite\n", nil
+	case "zsh":
+		return "#compdef fflite\n" +
+			"_fflite() {\n" +
+			"    _alternative 'fflite:fflite option or preset:(" + words + ")' 'files:file:_files'\n" +
+			"}\n" +
+			"if [ \"$funcstack[1]\" = \"_fflite\" ]; then\n" +
+			"    _fflite \"$@\"\n" +
+			"else\n" +
+			"    compdef _fflite fflite\n" +
+			"fi\n", nil
+	case "fish":
+		return "complete -c fflite -a \"" + words + "\"\n", nil
+	}
+	return "", fmt.Errorf("unknown shell %q, use bash, zsh or fish", shell)
+}
+
+// presetName returns readable name of preset regexp key.
+// Numbered groups are shown as ${1}, ${2}... placeholders they fill in the preset value.
+func presetName(key string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, "^"), "$")
+	n := 0
+	name = regexpMap["presetGroup"].ReplaceAllStringFunc(name, func(group string) string {
+		if strings.HasPrefix(group, "(?") {
+			return group
+		}
+		n++
+		return "${" + strconv.Itoa(n) + "}"
+	})
+	return strings.Replace(name, `\@`, "@", 1)
+}
+
+// checkPresetGroups returns an error if preset value refers to a group that is missing in the preset regexp.
+func checkPresetGroups(r *regexp.Regexp, value string) error {
+	for _, m := range regexpMap["presetRef"].FindAllStringSubmatch(value, -1) {
+		ref := m[1]
+		if ref == "" {
+			ref = m[2]
+		}
+		if n, _ := strconv.Atoi(ref); n > r.NumSubexp() {
+			return fmt.Errorf("preset value %q refers to group %v, but %q has only %v", value, n, r.String(), r.NumSubexp())
+		}
+	}
+	return nil
+}
+
+// handlersConfigPath returns the path of the config file with extra handler names to hide.
+func handlersConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fflite", "handlers.json")
+}
+
+// loadHideHandlers appends handler names from JSON array in config file at path to hideHandlers.
+func loadHideHandlers(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var custom []string
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	for _, v := range custom {
+		if _, err := filepath.Match(v, ""); err != nil {
+			return fmt.Errorf("%v: invalid handler pattern %q: %v", path, v, err)
+		}
+		hideHandlers = append(hideHandlers, v)
+	}
+	return nil
+}
+
+// loadPresets merges presets from JSON config file into presets map.
+// The file is an object of regexp keys and replacement values, same as the built-in presets.
+// User presets override built-in ones on key collision. Missing file is not an error.
+func loadPresets(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var custom map[string]string
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	for key, value := range custom {
+		r, err := regexp.Compile(key)
+		if err != nil {
+			return fmt.Errorf("%v: invalid preset regexp %q: %v", path, key, err)
+		}
+		if err := checkPresetGroups(r, value); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		presets[key] = value
+		userPresets[key] = true
+	}
+	return nil
+}
+
+// extendPatterns ORs newline-separated regexps from list into regexpMap[name].
+// Lines matching any of them are captured whole in the first group, same as the built-in ones.
+// Invalid regexps are reported and skipped.
+func extendPatterns(name, list string) {
+	var extra []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := regexp.Compile(line); err != nil {
+			consolePrint("\x1b[33;1mWARNING: skipping invalid " + name + " pattern \"" + line + "\": " + err.Error() + "\x1b[0m\n")
+			continue
+		}
+		extra = append(extra, ".*(?:"+line+").*")
+	}
+	if len(extra) == 0 {
+		return
+	}
+	// Built-in patterns are a single group, so put extra alternatives inside of it.
+	pattern := regexpMap[name].String()
+	regexpMap[name] = regexp.MustCompile(pattern[:len(pattern)-1] + "|" + strings.Join(extra, "|") + ")")
+}
+
+// preset is a JSON representation of a single preset.
+type preset struct {
+	Name   string `json:"name"`
+	Regexp string `json:"regexp"`
+	Value  string `json:"value"`
+	User   bool   `json:"user"`
+}
+
+// presetsJSON returns all presets sorted by key as JSON array.
+func presetsJSON() ([]byte, error) {
+	var keys []string
+	for k := range presets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := []preset{}
+	for _, key := range keys {
+		// User preset keys are not guaranteed to look like "^\@name$".
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, "^"), `\`), "$")
+		list = append(list, preset{name, key, presets[key], userPresets[key]})
+	}
+	return json.MarshalIndent(list, "", "  ")
+}
+
 // argsPreset replaces passed arguments with preset values.
 func argsPreset(input string) []string {
 	out := []string{input}
@@ -490,28 +1894,275 @@ func argsPreset(input string) []string {
 	return out
 }
 
-func getUpstreamVersion() string {
-	resp, err := http.Get("https://raw.githubusercontent.com/malashin/fflite/master/fflite.go")
+// streamConflicts are options that have no effect if their stream type is disabled in the same output.
+var streamConflicts = []struct {
+	disable string
+	kind    string
+	options []string
+}{
+	{"-an", "audio", []string{"-c:a", "-codec:a", "-acodec", "-b:a", "-ab", "-af", "-filter:a", "-ar", "-ac"}},
+	{"-vn", "video", []string{"-c:v", "-codec:v", "-vcodec", "-b:v", "-vf", "-filter:v", "-crf", "-pix_fmt"}},
+	{"-sn", "subtitles", []string{"-c:s", "-codec:s", "-scodec"}},
+}
+
+// commandConflicts returns warnings about options of the same output that contradict each other,
+// like audio codec set together with "-an" from a preset.
+func commandConflicts(ffCommand []string) []string {
+	warnings := []string{}
+	// Options of the current output with their values.
+	seen := [][2]string{}
+	check := func() {
+		for _, c := range streamConflicts {
+			disabled := false
+			for _, o := range seen {
+				if o[0] == c.disable {
+					disabled = true
+				}
+			}
+			if !disabled {
+				continue
+			}
+			for _, o := range seen {
+				for _, option := range c.options {
+					if o[0] == option || strings.HasPrefix(o[0], option+":") {
+						warnings = append(warnings, c.disable+" disables "+c.kind+", but \""+strings.TrimSpace(o[0]+" "+o[1])+"\" is also set for the same output")
+					}
+				}
+			}
+		}
+		seen = seen[:0]
+	}
+	for i := 0; i < len(ffCommand); i++ {
+		switch {
+		// Options before input belong to the input.
+		case ffCommand[i] == "-i":
+			seen = seen[:0]
+			i++
+		case strings.HasPrefix(ffCommand[i], "-") && len(ffCommand[i]) > 1:
+			if contains(singlekeys, ffCommand[i]) || i+1 == len(ffCommand) {
+				seen = append(seen, [2]string{ffCommand[i], ""})
+			} else {
+				seen = append(seen, [2]string{ffCommand[i], ffCommand[i+1]})
+				i++
+			}
+		// Output filename ends the options of the output.
+		default:
+			check()
+		}
+	}
+	return warnings
+}
+
+// getUpstreamVersion returns tag name of the latest fflite release on GitHub or empty string on failure.
+// Cached version is used if it is fresh enough unless force is set.
+func getUpstreamVersion(force bool) string {
+	// Offline installations don't need to be reminded that the check failed.
+	if updateCheckDisabled() {
+		return ""
+	}
+	upstreamVersion, err := latestVersion(force)
 	if err != nil {
 		consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
 		return ""
 	}
-	defer resp.Body.Close()
-	bytes, err := ioutil.ReadAll(resp.Body)
+	return upstreamVersion
+}
+
+// Range of ffmpeg major versions parsing of ffmpeg output is tested with.
+const (
+	ffmpegMinTested = 4
+	ffmpegMaxTested = 7
+)
+
+// ffmpegVersionCache is the version of ffmpeg binary stored in the user cache directory.
+// It is valid until the binary is modified.
+type ffmpegVersionCache struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	Version string    `json:"version"`
+}
+
+// ffmpegVersionCachePath returns the path of the ffmpeg version cache file.
+func ffmpegVersionCachePath() string {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		consolePrint("\x1b[31;1m")
-		consolePrint(err)
-		consolePrint("\x1b[0m\n")
 		return ""
 	}
-	r := regexp.MustCompile(`var version = "(.*)"`)
-	version := r.FindString(string(bytes))
-	version = r.ReplaceAllString(version, "$1")
-	return version
+	return filepath.Join(dir, "fflite", "ffmpeg.json")
+}
+
+// ffmpegVersion returns version of ffmpeg binary from "ffmpeg -version", like "6.1.1" or "N-112000-g1234abcd" for git builds.
+// Version is cached, ffmpeg is run again only if the binary has changed.
+func ffmpegVersion() (string, error) {
+	path, err := exec.LookPath(ffmpegBin)
+	if err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	cachePath := ffmpegVersionCachePath()
+	if cachePath != "" {
+		var cache ffmpegVersionCache
+		if data, err := ioutil.ReadFile(cachePath); err == nil && json.Unmarshal(data, &cache) == nil && cache.Path == path && cache.ModTime.Equal(info.ModTime()) && cache.Size == info.Size() && cache.Version != "" {
+			return cache.Version, nil
+		}
+	}
+	out, err := exec.Command(path, "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	m := regexpMap["ffmpegVersion"].FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unknown \"%v -version\" output", ffmpegBin)
+	}
+	version := string(m[1])
+	if cachePath != "" {
+		if data, err := json.Marshal(ffmpegVersionCache{path, info.ModTime(), info.Size(), version}); err == nil && os.MkdirAll(filepath.Dir(cachePath), 0775) == nil {
+			ioutil.WriteFile(cachePath, data, 0664)
+		}
+	}
+	return version, nil
+}
+
+// ffmpegVersionWarning returns warning if ffmpeg major version is outside of the tested range or empty string otherwise.
+// Git builds don't have a version number and are not checked.
+func ffmpegVersionWarning(version string) string {
+	m := regexpMap["ffmpegMajor"].FindStringSubmatch(version)
+	if m == nil {
+		return ""
+	}
+	major, _ := strconv.Atoi(m[1])
+	tested := strconv.Itoa(ffmpegMinTested) + ".x-" + strconv.Itoa(ffmpegMaxTested) + ".x"
+	switch {
+	case major < ffmpegMinTested:
+		return "ffmpeg " + version + " is older than tested versions " + tested + ", progress and encoding summary lines may not be recognized"
+	case major > ffmpegMaxTested:
+		return "ffmpeg " + version + " is newer than tested versions " + tested + ", progress and encoding summary lines may not be recognized"
+	}
+	return ""
+}
+
+// updateCheckDisabled reports whether network version checks are disabled with FFLITE_NO_UPDATE_CHECK.
+func updateCheckDisabled() bool {
+	return os.Getenv("FFLITE_NO_UPDATE_CHECK") != ""
+}
+
+// versionCacheTTL is how long fetched upstream version is reused, FFLITE_VERSION_CACHE_TTL overrides it.
+const versionCacheTTL = 24 * time.Hour
+
+// versionCache is the upstream version check result stored in the user cache directory.
+type versionCache struct {
+	Version string    `json:"version"`
+	Checked time.Time `json:"checked"`
+}
+
+// versionCachePath returns the path of the upstream version cache file.
+func versionCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fflite", "version.json")
+}
+
+// latestVersion returns tag name of the latest fflite release.
+// Cached version is returned if it was fetched less than TTL ago, unless force is set.
+// Freshly fetched version is saved to the cache, cache errors are ignored.
+func latestVersion(force bool) (string, error) {
+	if updateCheckDisabled() {
+		return "", fmt.Errorf("update check is disabled with FFLITE_NO_UPDATE_CHECK")
+	}
+	ttl := versionCacheTTL
+	if d, err := time.ParseDuration(os.Getenv("FFLITE_VERSION_CACHE_TTL")); err == nil {
+		ttl = d
+	}
+	path := versionCachePath()
+	if !force && ttl > 0 && path != "" {
+		var cache versionCache
+		if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &cache) == nil && cache.Version != "" && time.Since(cache.Checked) < ttl {
+			return cache.Version, nil
+		}
+	}
+	upstreamVersion, err := fetchUpstreamVersion()
+	if err != nil {
+		return "", err
+	}
+	if path != "" {
+		if data, err := json.Marshal(versionCache{upstreamVersion, time.Now()}); err == nil && os.MkdirAll(filepath.Dir(path), 0775) == nil {
+			ioutil.WriteFile(path, data, 0664)
+		}
+	}
+	return upstreamVersion, nil
+}
+
+// fetchUpstreamVersion returns tag name of the latest fflite release on GitHub.
+func fetchUpstreamVersion() (string, error) {
+	req, err := http.NewRequest("GET", "https://api.github.com/repos/malashin/fflite/releases/latest", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			return "", fmt.Errorf("GitHub API rate limit exceeded, try again later")
+		}
+		return "", fmt.Errorf("GitHub API request failed: %v", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return release.TagName, nil
+}
+
+// versionInfo is printed by "version-json" option.
+type versionInfo struct {
+	Current  string `json:"current"`
+	Latest   string `json:"latest"`
+	UpToDate bool   `json:"up_to_date"`
+	Error    string `json:"error,omitempty"`
+}
+
+// printVersionJSON prints current and latest fflite versions as JSON.
+// It returns exit status: 0 if fflite is up to date, 1 if update is available and 2 if the check failed.
+func printVersionJSON() int {
+	info := versionInfo{Current: version}
+	status := 0
+	latest, err := latestVersion(false)
+	switch {
+	case err != nil:
+		info.Error = err.Error()
+		status = 2
+	case latest != version:
+		info.Latest = latest
+		status = 1
+	default:
+		info.Latest = latest
+		info.UpToDate = true
+	}
+	out, _ := json.Marshal(info)
+	fmt.Println(string(out))
+	return status
 }
 
 func updateVersion() error {
-	upstreamVersion := getUpstreamVersion()
+	if updateCheckDisabled() {
+		return fmt.Errorf("update check is disabled with FFLITE_NO_UPDATE_CHECK, unset it to update fflite")
+	}
+	upstreamVersion := getUpstreamVersion(true)
 	if upstreamVersion == "" {
 		return nil
 	}
@@ -523,8 +2174,11 @@ func updateVersion() error {
 	consolePrint("fflite version is \x1b[31;1m" + version + "\x1b[0m.\n")
 	consolePrint("Latest version is \x1b[33;1m" + upstreamVersion + "\x1b[0m.\n")
 	consolePrint("\x1b[31;1mYour fflite is out of date.\x1b[0m\n")
-	consolePrint("\x1b[30;1mgo get -u -v github.com/malashin/fflite\x1b[0m\n")
-	cmd := exec.Command("go", "get", "-u", "-v", "github.com/malashin/fflite")
+	if _, err := exec.LookPath("go"); err != nil {
+		return fmt.Errorf("go is not found in $PATH, install Go to update fflite")
+	}
+	consolePrint("\x1b[30;1mgo install -v github.com/malashin/fflite@latest\x1b[0m\n")
+	cmd := exec.Command("go", "install", "-v", "github.com/malashin/fflite@latest")
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
@@ -541,136 +2195,529 @@ func updateVersion() error {
 	return err
 }
 
-func parseOptions(input []string) (ffmpeg bool, nologs bool, cwdlogs bool, crop bool, cropDetectNumber int, cropDetectLimit float64, sync bool, mute bool, args []string) {
-	switch {
-	// "ffmpeg" run the same command in ffmpeg instead of fflite.
-	case input[0] == "ffmpeg":
-		ffmpeg = true
-		args = input[1:]
-	// "nologs" don't save error log files.
-	case input[0] == "nologs":
-		nologs = true
-		args = input[1:]
-	// "cwdlogs" save error log files in the current work directory.
-	case input[0] == "cwdlogs":
-		cwdlogs = true
-		args = input[1:]
-	// "crop" runs cropDetect on input file.
-	case regexpMap["cropMode"].MatchString(input[0]):
-		crop = true
-		args = input[1:]
-		cropDetectNumber = 5      // default values
-		cropDetectLimit = 0.10625 // default values
-		cropModeValues := regexpMap["cropMode"].FindStringSubmatch(input[0])
-		// If crop argument was passed with crop values.
-		if cropModeValues[1] != "" {
-			values := strings.Split(cropModeValues[1], ":")
-			// If there is no ":" in the crop values.
-			if len(values) == 1 {
-				v, err := strconv.ParseFloat(values[0], 64)
-				if err != nil {
-					consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
-					return
+// options holds fflite options passed before ffmpeg arguments.
+type options struct {
+	ffmpeg           bool
+	banner           bool
+	nologs           bool
+	cwdlogs          bool
+	logName          string
+	crop             bool
+	cropDetectNumber int
+	cropDetectLimit  float64
+	cropDetectTimes  []float64
+	sync             bool
+	syncRate         int64
+	syncFormat       string
+	mute             bool
+	notify           bool
+	pause            bool
+	decimalPercent   bool
+	noCR             bool
+	throttle         time.Duration
+	hwCheck          bool
+	twoPass          bool
+	totalFrames      int
+	failFast         bool
+	outDir           string
+	skipExisting     bool
+	natsort          bool
+	concat           bool
+	multiIn          bool
+	explain          bool
+	statsLine        bool
+	bar              bool
+	cleanOnFail      bool
+	handlers         bool
+	dryRun           bool
+	quiet            bool
+	debug            bool
+	etaWindow        int
+	warnLimit        int
+	retries          int
+	stallTimeout     time.Duration
+	noColor          bool
+	autoCrop         bool
+	progressPipe     bool
+	progressJSON     string
+	runLog           string
+	webhook          string
+	timings          string
+	cropOut          string
+	emitScript       string
+	jsonReport       string
+	minFree          uint64
+	overwrite        string
+	nice             int
+	progressFile     *os.File
+}
+
+// parseOptions parses fflite options at the start of input and returns them with the remaining ffmpeg arguments.
+// Several options can be combined, parsing stops at the first argument that is not an fflite option.
+func parseOptions(input []string) (opts options, args []string) {
+	opts.etaWindow = 30 // default value
+	opts.warnLimit = 10
+	opts.syncFormat = "flac"
+	for len(input) > 0 {
+		switch {
+		// "ffmpeg" run the same command in ffmpeg instead of fflite.
+		case input[0] == "ffmpeg":
+			opts.ffmpeg = true
+		// "banner" keeps ffmpeg version and configuration banner.
+		case input[0] == "banner":
+			opts.banner = true
+		// "nologs" don't save error log files.
+		case input[0] == "nologs":
+			opts.nologs = true
+		// "cwdlogs" save error log files in the current work directory.
+		case input[0] == "cwdlogs":
+			opts.cwdlogs = true
+		// "crop" runs cropDetect on input file.
+		// "autocrop" runs cropDetect and encodes input file with detected crop.
+		case regexpMap["cropMode"].MatchString(input[0]):
+			cropModeValues := regexpMap["cropMode"].FindStringSubmatch(input[0])
+			if cropModeValues[1] == "auto" {
+				opts.autoCrop = true
+			} else {
+				opts.crop = true
+			}
+			opts.cropDetectNumber = 5      // default values
+			opts.cropDetectLimit = 0.10625 // default values
+			// If crop argument was passed with explicit sample timecodes "crop@00:05:00,00:30:00".
+			if strings.HasPrefix(cropModeValues[2], "@") {
+				for _, t := range strings.Split(cropModeValues[2][1:], ",") {
+					if !regexpMap["timecode"].MatchString(t) {
+						consolePrint("\x1b[31;1mERROR: invalid crop sample timecode \"" + t + "\".\x1b[0m\n")
+						os.Exit(1)
+					}
+					opts.cropDetectTimes = append(opts.cropDetectTimes, hhmmssmsToSeconds(t))
 				}
-				// If crop value is less then 1 use it as cropDetect limit, cropDetect number otherwise.
-				if v < 1 {
-					cropDetectLimit = v
+				opts.cropDetectNumber = len(opts.cropDetectTimes)
+			} else if cropModeValues[2] != "" {
+				// If crop argument was passed with crop values.
+				values := strings.Split(cropModeValues[2], ":")
+				// If there is no ":" in the crop values.
+				if len(values) == 1 {
+					v, err := strconv.ParseFloat(values[0], 64)
+					if err != nil {
+						consolePrint("\x1b[31;1mERROR: invalid crop value \"" + values[0] + "\".\x1b[0m\n")
+						os.Exit(1)
+					}
+					// If crop value is less then 1 use it as cropDetect limit, cropDetect number otherwise.
+					if v < 1 {
+						opts.cropDetectLimit = v
+					} else {
+						opts.cropDetectNumber = int(round(v))
+					}
 				} else {
-					cropDetectNumber = int(round(v))
-				}
-			} else {
-				// Parse crop values if they are separated with ":".
-				i, err := strconv.ParseInt(values[0], 10, 64)
-				cropDetectNumber = int(i)
-				if err != nil {
-					consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
-					return
+					// Parse crop values if they are separated with ":".
+					i, err := strconv.ParseInt(values[0], 10, 64)
+					opts.cropDetectNumber = int(i)
+					if err != nil {
+						consolePrint("\x1b[31;1mERROR: invalid crop value \"" + values[0] + "\".\x1b[0m\n")
+						os.Exit(1)
+					}
+					opts.cropDetectLimit, err = strconv.ParseFloat(values[1], 64)
+					if err != nil {
+						consolePrint("\x1b[31;1mERROR: invalid crop value \"" + values[1] + "\".\x1b[0m\n")
+						os.Exit(1)
+					}
 				}
-				cropDetectLimit, err = strconv.ParseFloat(values[1], 64)
-				if err != nil {
-					consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
-					return
+			}
+		// "sync" speeds up or slows down audio file for it's duration to match video files duration.
+		// Target sample rate can be passed as "sync44100" or "sync:44100", 48000 is used by default.
+		case regexpMap["syncMode"].MatchString(input[0]):
+			opts.sync = true
+			opts.syncRate = 48000 // default value
+			if rate := regexpMap["syncMode"].FindStringSubmatch(input[0])[1]; rate != "" {
+				r, err := strconv.ParseInt(rate, 10, 64)
+				if err != nil || r < 1 {
+					consolePrint("\x1b[31;1mERROR: invalid sync sample rate \"" + rate + "\".\x1b[0m\n")
+					os.Exit(1)
 				}
+				opts.syncRate = r
+			}
+		case input[0] == "mute":
+			opts.mute = true
+		// "skipexisting" skips batch items whose outputs already exist.
+		case input[0] == "skipexisting":
+			opts.skipExisting = true
+		// "dryrun" prints ffmpeg commands without executing them.
+		case input[0] == "dryrun":
+			opts.dryRun = true
+		// "nocolor" disables colored output.
+		case input[0] == "nocolor" || input[0] == "--no-color":
+			opts.noColor = true
+		// "progresspipe" reads progress from ffmpeg -progress output instead of stats lines.
+		case input[0] == "progresspipe":
+			if runtime.GOOS == "windows" {
+				consolePrint("\x1b[33;1mWARNING: progresspipe is not supported on Windows, stats lines are used instead.\x1b[0m\n")
+			} else {
+				opts.progressPipe = true
+			}
+		// "quiet" prints only errors and the final result of each file.
+		case input[0] == "quiet":
+			opts.quiet = true
+		// "debug" prints raw ffmpeg lines to stderr before parsing them.
+		case input[0] == "debug":
+			opts.debug = true
+		// "notify" sends desktop notification when batch is finished.
+		case input[0] == "notify":
+			opts.notify = true
+		// "pause" toggles pause of ffmpeg with "p" key.
+		case input[0] == "pause":
+			opts.pause = true
+		// "-explain" prints preset expansions.
+		case input[0] == "-explain":
+			opts.explain = true
+		// "handlers" prints stream handler names on stream lines.
+		case input[0] == "handlers":
+			opts.handlers = true
+		// "statsline" prints "FFLITE_STATS" line to stderr after encoding.
+		case input[0] == "statsline":
+			opts.statsLine = true
+		// "-clean-on-fail" removes outputs of failed and interrupted encodes.
+		case input[0] == "-clean-on-fail":
+			opts.cleanOnFail = true
+		// "-bar" shows progress bar.
+		case input[0] == "-bar":
+			opts.bar = true
+		// "-no-cr" prints progress updates on separate lines.
+		case input[0] == "-no-cr":
+			opts.noCR = true
+		// "decimalpercent" shows progress percentage with one decimal place.
+		case input[0] == "decimalpercent":
+			opts.decimalPercent = true
+		// "failfast" stops the batch on the first failed file.
+		case input[0] == "failfast":
+			opts.failFast = true
+		// "natsort" sorts batch files in natural order.
+		case input[0] == "natsort":
+			opts.natsort = true
+		// "concat" joins batch inputs into one output.
+		case input[0] == "concat":
+			opts.concat = true
+		// "multiin" passes batch inputs to a single command.
+		case input[0] == "multiin":
+			opts.multiIn = true
+		// "-eta-window <N>" sets number of speed samples averaged for ETA.
+		case input[0] == "-eta-window" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 1 {
+				consolePrint("\x1b[31;1mERROR: -eta-window must be a positive integer, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.etaWindow = n
+			input = input[1:]
+		// "-warn-limit <N>" sets number of repeated warnings shown before omitting them.
+		case input[0] == "-warn-limit" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 0 {
+				consolePrint("\x1b[31;1mERROR: -warn-limit must be a non-negative integer, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.warnLimit = n
+			input = input[1:]
+		// "-retries <N>" retries failed batch items N times.
+		case input[0] == "-retries" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 0 {
+				consolePrint("\x1b[31;1mERROR: -retries must be a non-negative integer, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
 			}
+			opts.retries = n
+			input = input[1:]
+		// "-stall-timeout <seconds>" kills ffmpeg if there is no progress for that long.
+		case input[0] == "-stall-timeout" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 1 {
+				consolePrint("\x1b[31;1mERROR: -stall-timeout must be a positive number of seconds, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.stallTimeout = time.Duration(n) * time.Second
+			input = input[1:]
+		// "-throttle <ms>" limits progress updates to one per ms milliseconds.
+		case input[0] == "-throttle" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 0 {
+				consolePrint("\x1b[31;1mERROR: -throttle must be a non-negative number of milliseconds, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.throttle = time.Duration(n) * time.Millisecond
+			input = input[1:]
+		// "-sync-format <format>" sets output format of sync mode.
+		case input[0] == "-sync-format" && len(input) > 1:
+			if _, ok := syncFormats[input[1]]; !ok {
+				consolePrint("\x1b[31;1mERROR: unknown sync format \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.syncFormat = input[1]
+			input = input[1:]
+		// "-progress-json <path>" writes progress updates as newline-delimited JSON to path.
+		case input[0] == "-progress-json" && len(input) > 1:
+			opts.progressJSON = input[1]
+			input = input[1:]
+		// "-logname <template>" sets error log filename template.
+		case input[0] == "-logname" && len(input) > 1:
+			opts.logName = input[1]
+			input = input[1:]
+		// "-runlog <path>" appends the whole session output to path.
+		case input[0] == "-runlog" && len(input) > 1:
+			opts.runLog = input[1]
+			input = input[1:]
+		// "-webhook <url>" posts run results as JSON to url when finished.
+		case input[0] == "-webhook" && len(input) > 1:
+			opts.webhook = input[1]
+			input = input[1:]
+		// "-timings <path>" appends encoding time of each file to CSV file.
+		case input[0] == "-timings" && len(input) > 1:
+			opts.timings = input[1]
+			input = input[1:]
+		// "-emit-script <path>" appends escaped ffmpeg commands to a shell script.
+		case input[0] == "-emit-script" && len(input) > 1:
+			opts.emitScript = input[1]
+			input = input[1:]
+		// "-crop-out <path>" appends crop detected in crop mode to CSV file.
+		case input[0] == "-crop-out" && len(input) > 1:
+			opts.cropOut = input[1]
+			input = input[1:]
+		// "-json-report <path>" writes JSON summary of the run to file.
+		case input[0] == "-json-report" && len(input) > 1:
+			opts.jsonReport = input[1]
+			input = input[1:]
+		// "-overwrite" and "-no-overwrite" pass "-y" or "-n" to ffmpeg.
+		case input[0] == "-overwrite":
+			opts.overwrite = "-y"
+		case input[0] == "-no-overwrite":
+			opts.overwrite = "-n"
+		// "-nice <N>" sets niceness of ffmpeg process.
+		case input[0] == "-nice" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil {
+				consolePrint("\x1b[31;1mERROR: -nice must be an integer, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			if n < -20 || n > 19 {
+				clamped := int(math.Max(-20, math.Min(19, float64(n))))
+				consolePrint("\x1b[33;1mWARNING: -nice " + input[1] + " is out of range from -20 to 19, using " + strconv.Itoa(clamped) + ".\x1b[0m\n")
+				n = clamped
+			}
+			opts.nice = n
+			input = input[1:]
+		// "-total-frames <N>" sets number of input frames for progress if duration is unknown.
+		case input[0] == "-total-frames" && len(input) > 1:
+			n, err := strconv.Atoi(input[1])
+			if err != nil || n < 1 {
+				consolePrint("\x1b[31;1mERROR: -total-frames must be a positive integer, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.totalFrames = n
+			input = input[1:]
+		// "-outdir <path>" writes batch outputs into path.
+		case input[0] == "-outdir" && len(input) > 1:
+			opts.outDir = input[1]
+			input = input[1:]
+		// "-min-free <size>" refuses to encode if output filesystem has less free space than size.
+		case input[0] == "-min-free" && len(input) > 1:
+			n, err := parseSize(input[1])
+			if err != nil {
+				consolePrint("\x1b[31;1mERROR: -min-free must be a size like 500M or 5G, got \"" + input[1] + "\".\x1b[0m\n")
+				os.Exit(1)
+			}
+			opts.minFree = n
+			input = input[1:]
+		// "hwcheck" prints available hardware encoders and exits.
+		case input[0] == "hwcheck":
+			opts.hwCheck = true
+		// "update" check upstream version.
+		case input[0] == "version":
+			upstreamVersion := getUpstreamVersion(false)
+			if upstreamVersion == "" {
+				consolePrint("fflite version \x1b[33;1m" + version + "\x1b[0m.\n")
+			} else if version != upstreamVersion {
+				consolePrint("fflite version is \x1b[31;1m" + version + "\x1b[0m.\n")
+				consolePrint("Latest version is \x1b[33;1m" + upstreamVersion + "\x1b[0m.\n")
+				consolePrint("\x1b[31;1mYour fflite is out of date.\x1b[0m\n")
+				consolePrint("Use this command to update it:\n")
+				consolePrint("\x1b[30;1mfflite update\x1b[0m\n")
+			} else {
+				consolePrint("fflite version \x1b[32;1m" + version + "\x1b[0m.\n")
+				consolePrint("\x1b[32;1mYour fflite is up to date.\x1b[0m\n")
+			}
+			os.Exit(0)
+		// "version-json" prints version check result as JSON for scripts.
+		case input[0] == "version-json":
+			os.Exit(printVersionJSON())
+		// "presets-json" prints presets as JSON for external tools.
+		case input[0] == "presets-json":
+			out, err := presetsJSON()
+			if err != nil {
+				consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+			os.Exit(0)
+		case input[0] == "update":
+			err := updateVersion()
+			if err != nil {
+				consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+			}
+			os.Exit(0)
+		// "completion <shell>" prints shell completion script.
+		case input[0] == "completion" && len(input) > 1:
+			script, err := completionScript(input[1])
+			if err != nil {
+				consolePrint("\x1b[31;1mERROR: " + err.Error() + "\x1b[0m\n")
+				os.Exit(1)
+			}
+			fmt.Print(script)
+			os.Exit(0)
+		default:
+			args = input
+			return
 		}
-	// "sync" speeds up or slows down audio file for it's duration to match video files duration.
-	case input[0] == "sync":
-		sync = true
-		args = input[1:]
-	case input[0] == "mute":
-		mute = true
-		args = input[1:]
-	// "update" check upstream version.
-	case input[0] == "version":
-		upstreamVersion := getUpstreamVersion()
-		if version != upstreamVersion {
-			consolePrint("fflite version is \x1b[31;1m" + version + "\x1b[0m.\n")
-			consolePrint("Latest version is \x1b[33;1m" + upstreamVersion + "\x1b[0m.\n")
-			consolePrint("\x1b[31;1mYour fflite is out of date.\x1b[0m\n")
-			consolePrint("Use this command to update it:\n")
-			consolePrint("\x1b[30;1mfflite update\x1b[0m\n")
-		} else {
-			consolePrint("fflite version \x1b[32;1m" + version + "\x1b[0m.\n")
-			consolePrint("\x1b[32;1mYour fflite is up to date.\x1b[0m\n")
+		input = input[1:]
+	}
+	return
+}
+
+// outputsExist reports whether all outputs are present and non-empty.
+func outputsExist(outputs []string) bool {
+	if len(outputs) == 0 {
+		return false
+	}
+	for _, output := range outputs {
+		info, err := os.Stat(output)
+		if err != nil || info.Size() == 0 {
+			return false
 		}
-		os.Exit(0)
-	case input[0] == "update":
-		err := updateVersion()
-		if err != nil {
-			consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+	}
+	return true
+}
+
+// nullSink returns null device path of the current platform.
+func nullSink() string {
+	return os.DevNull
+}
+
+// existingFiles returns arguments of ffmpeg command that are names of existing files.
+func existingFiles(ffCommand []string) map[string]bool {
+	existed := map[string]bool{}
+	for _, v := range ffCommand {
+		if _, err := os.Stat(v); err == nil {
+			existed[filepath.Clean(v)] = true
 		}
-		os.Exit(0)
-	default:
-		args = input
 	}
-	return
+	return existed
+}
+
+// removePartialOutputs removes outputs of failed or interrupted encode that didn't exist before it was started.
+// Inputs, null sinks, pipes and URLs are never removed.
+func removePartialOutputs(outputs, ffCommand []string, existed map[string]bool) {
+	inputs := map[string]bool{}
+	for i := 0; i+1 < len(ffCommand); i++ {
+		if ffCommand[i] == "-i" {
+			inputs[filepath.Clean(strings.TrimPrefix(ffCommand[i+1], "file:"))] = true
+		}
+	}
+	removed := map[string]bool{}
+	for _, output := range outputs {
+		output = strings.TrimPrefix(output, "file:")
+		if output == "" || isNullSink(output) || isStreamInput(output) {
+			continue
+		}
+		path := filepath.Clean(output)
+		if existed[path] || inputs[path] || removed[path] {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			consolePrint("\x1b[33;1mWARNING: " + err.Error() + "\x1b[0m\n")
+			continue
+		}
+		removed[path] = true
+		consolePrint("\x1b[33;1mRemoved partial output \"" + output + "\"\x1b[0m\n")
+	}
+}
+
+// isStreamInput reports whether input is a pipe or a network stream without known duration.
+func isStreamInput(input string) bool {
+	return input == "-" || strings.HasPrefix(input, "pipe:") || strings.Contains(input, "://")
+}
+
+// isNullSink reports whether output is a null device on any platform.
+func isNullSink(output string) bool {
+	return strings.EqualFold(output, "NUL") || output == "/dev/null" || output == os.DevNull
+}
+
+// getDuration returns duration of the input file in seconds or 0 if it is unknown.
+// ffprobe is used if available, otherwise duration is parsed from ffmpeg output.
+func getDuration(input string) float64 {
+	if duration, err := probeDuration(input); err == nil {
+		return duration
+	}
+	cmd := exec.Command(ffmpegBin, "-hide_banner", "-i", input)
+	stdoutStderr, _ := cmd.CombinedOutput()
+	output := string(regexpMap["durationHHMMSSMS"].Find(stdoutStderr))
+	if output == "" {
+		return 0
+	}
+	return hhmmssmsToSeconds(regexpMap["durationHHMMSSMS"].ReplaceAllString(output, "${1}"))
+}
+
+// probeDuration returns duration of the input file in seconds using ffprobe.
+func probeDuration(input string) (float64, error) {
+	out, err := exec.Command(ffprobeBin, "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", input).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
 }
 
 // cropDetect parses the input file for the necessary cropping parameters.
-func cropDetect(firstInput string, cropDetectCount int, cropDetectLimit float64) {
+// Samples are evenly spread across the duration or taken at times in seconds if they are set.
+// It returns the crop that fits all samples, ok is false if crop could not be detected.
+func cropDetect(firstInput string, cropDetectCount int, cropDetectLimit float64, times []float64) (result crop, ok bool) {
 	cropDetectDur := "2" // One second in ffmpeg format
 	cropDetectParams := strconv.FormatFloat(cropDetectLimit, 'f', -1, 64) + ":2:0"
-	cmd := exec.Command("ffmpeg", "-i", firstInput)
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil && fmt.Sprint(err) != "exit status 1" {
-		consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+	duration := 0.0
+	if len(times) == 0 {
+		duration = getDuration(firstInput)
 	}
-	output := string(regexpMap["durationHHMMSSMS"].Find(stdoutStderr))
-	duration := hhmmssmsToSeconds(regexpMap["durationHHMMSSMS"].ReplaceAllString(output, "${1}"))
 	consolePrint("\x1b[32;1m", firstInput, "\x1b[0m\n")
 	consolePrint("\x1b[30;1m", "Running cropDetect ", cropDetectCount, " times, with the following parameters ", cropDetectParams, "\x1b[0m\n")
+	// Detected crop and timecode of each sample.
+	var samples []crop
+	var timecodes []string
+	// Number of samples discarded because all of their frames are black.
+	discarded := 0
 	for i := 1; i <= cropDetectCount; i++ {
-		var cropArrayLocal []crop
 		tempDur := duration * float64(i) / (float64(cropDetectCount) + 1.0)
-		ffCommand := []string{"-ss",
-			strconv.FormatFloat(tempDur, 'f', -1, 64),
-			"-i",
-			firstInput,
-			"-vf",
-			"cropdetect=" + cropDetectParams,
-			"-t",
-			cropDetectDur,
-			"-an",
-			"-f",
-			"null",
-			"nul"}
-		cmd := exec.Command("ffmpeg", ffCommand...)
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+		if len(times) > 0 {
+			tempDur = times[i-1]
 		}
-		cropLines := regexpMap["crop"].FindAll(stdoutStderr, -1)
-		for _, v := range cropLines {
-			w, _ := strconv.Atoi(regexpMap["crop"].ReplaceAllString(string(v), "${2}"))
-			h, _ := strconv.Atoi(regexpMap["crop"].ReplaceAllString(string(v), "${3}"))
-			x, _ := strconv.Atoi(regexpMap["crop"].ReplaceAllString(string(v), "${4}"))
-			y, _ := strconv.Atoi(regexpMap["crop"].ReplaceAllString(string(v), "${5}"))
-			crop := crop{w, h, x, y}
-			cropArrayLocal = append(cropArrayLocal, crop)
+		// Retry black samples at slightly later times.
+		var cropArrayLocal []crop
+		for _, offset := range []float64{0, 10, 30, 60} {
+			if offset > 0 && duration > 0 && tempDur+offset >= duration {
+				break
+			}
+			var err error
+			cropArrayLocal, err = cropDetectAt(firstInput, tempDur+offset, cropDetectParams, cropDetectDur)
+			if err != nil {
+				consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
+				return
+			}
+			if len(cropArrayLocal) > 0 {
+				tempDur += offset
+				break
+			}
 		}
 		if len(cropArrayLocal) == 0 {
-			consolePrint("\x1b[31;1m", "", "\x1b[0m\n")
-			return
+			discarded++
+			continue
 		}
 		crop := cropArrayLocal[0]
 		for _, v := range cropArrayLocal {
@@ -678,8 +2725,138 @@ func cropDetect(firstInput string, cropDetectCount int, cropDetectLimit float64)
 				crop = v
 			}
 		}
-		consolePrint("\x1b[30;1m", secondsToHHMMSS(strconv.FormatFloat(tempDur, 'f', -1, 64)), " crop=\x1b[0m", crop.w, "\x1b[30;1m:\x1b[0m", crop.h, "\x1b[30;1m:\x1b[0m", crop.x, "\x1b[30;1m:\x1b[0m", crop.y, "\n")
+		samples = append(samples, crop)
+		timecodes = append(timecodes, secondsToHHMMSS(strconv.FormatFloat(tempDur, 'f', -1, 64)))
+		if len(samples) == 1 {
+			result = crop
+		} else {
+			result = result.union(crop)
+		}
+	}
+	if discarded > 0 {
+		consolePrint("\x1b[33;1mWARNING: discarded ", discarded, " of ", cropDetectCount, " samples with black frames only.\x1b[0m\n")
+	}
+	if len(samples) == 0 {
+		if cropDetectCount > 0 {
+			consolePrint("\x1b[31;1mERROR: no usable crop samples.\x1b[0m\n")
+		}
+		return
+	}
+	// Print out samples, highlighting the ones that differ from the most common crop.
+	mode, count := cropMode(samples)
+	for i, c := range samples {
+		if c == mode {
+			consolePrint("\x1b[30;1m", timecodes[i], " crop=\x1b[0m", c.w, "\x1b[30;1m:\x1b[0m", c.h, "\x1b[30;1m:\x1b[0m", c.x, "\x1b[30;1m:\x1b[0m", c.y, "\n")
+		} else {
+			consolePrint("\x1b[30;1m", timecodes[i], " crop=\x1b[33;1m", c.w, ":", c.h, ":", c.x, ":", c.y, "\x1b[0m\n")
+		}
+	}
+	if count < len(samples) && len(times) > 0 {
+		consolePrint("\x1b[33;1mWARNING: crop differs in ", len(samples)-count, " of ", len(samples), " samples, try more sample timecodes.\x1b[0m\n")
+	} else if count < len(samples) {
+		consolePrint("\x1b[33;1mWARNING: crop differs in ", len(samples)-count, " of ", len(samples), " samples, try a higher number of samples (crop", cropDetectCount*2, ").\x1b[0m\n")
+	}
+	// Print out the crop that fits all samples.
+	consolePrint("\x1b[32;1mRecommended:\x1b[0m -vf crop=" + result.String() + "\n")
+	if even := result.even(); even != result {
+		consolePrint("\x1b[32;1mEven values:\x1b[0m -vf crop=" + even.String() + "\n")
+	}
+	return result, true
+}
+
+// autoCrop detects crop of the first input and encodes ffCommand with it.
+func autoCrop(ffCommand []string, batchMode bool, opts options) (errorsArray []string, firstInput string, success bool) {
+	for i := 0; i+1 < len(ffCommand); i++ {
+		if ffCommand[i] == "-i" {
+			firstInput = ffCommand[i+1]
+			break
+		}
+	}
+	c, ok := cropDetect(firstInput, opts.cropDetectNumber, opts.cropDetectLimit, opts.cropDetectTimes)
+	if !ok {
+		line := "     \x1b[31;1mERROR: cannot detect crop for \"" + firstInput + "\".\x1b[0m\n"
+		consolePrint(line)
+		exitStatus = 1
+		return []string{line}, firstInput, false
+	}
+	return encodeFile(injectCrop(ffCommand, c.even()), batchMode, opts)
+}
+
+// injectCrop returns a copy of ffCommand with crop prepended to video filters of every output.
+// Crop goes first so it is applied to source frames before filters like scale or pad.
+// If there are no video filters "-vf crop" is added before the last output filename.
+func injectCrop(ffCommand []string, c crop) []string {
+	out := make([]string, len(ffCommand))
+	copy(out, ffCommand)
+	filter := "crop=" + c.String()
+	found := false
+	for i := 0; i+1 < len(out); i++ {
+		if out[i] == "-vf" || out[i] == "-filter:v" {
+			out[i+1] = filter + "," + out[i+1]
+			found = true
+		}
+	}
+	if found || len(out) == 0 {
+		return out
 	}
+	last := len(out) - 1
+	return append(out[:last], "-vf", filter, ffCommand[last])
+}
+
+// cropDetectAt runs cropdetect filter on dur seconds of input starting at t seconds.
+// It returns detected crops, skipping black frames with zero or negative width or height.
+func cropDetectAt(input string, t float64, params, dur string) ([]crop, error) {
+	ffCommand := []string{"-hide_banner",
+		"-ss",
+		strconv.FormatFloat(t, 'f', -1, 64),
+		"-i",
+		input,
+		"-vf",
+		"cropdetect=" + params,
+		"-t",
+		dur,
+		"-an",
+		"-f",
+		"null",
+		nullSink()}
+	cmd := exec.Command(ffmpegBin, ffCommand...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := startFFmpeg(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var crops []crop
+	for _, v := range regexpMap["crop"].FindAllSubmatch(output.Bytes(), -1) {
+		w, _ := strconv.Atoi(string(v[2]))
+		h, _ := strconv.Atoi(string(v[3]))
+		x, _ := strconv.Atoi(string(v[4]))
+		y, _ := strconv.Atoi(string(v[5]))
+		if w <= 0 || h <= 0 {
+			continue
+		}
+		crops = append(crops, crop{w, h, x, y})
+	}
+	return crops, nil
+}
+
+// cropMode returns the most common crop of samples and number of its occurrences.
+// If several crops are equally common the first one of them is returned.
+func cropMode(samples []crop) (mode crop, count int) {
+	counts := map[crop]int{}
+	for _, c := range samples {
+		counts[c]++
+	}
+	for _, c := range samples {
+		if counts[c] > count {
+			mode, count = c, counts[c]
+		}
+	}
+	return
 }
 
 type crop struct {
@@ -689,243 +2866,514 @@ type crop struct {
 	y int
 }
 
-func audioSync(args []string, batchMode bool) (errors []string, input2 string) {
-	var input1 string
-	// Find two inputs.
-	for i := 0; i < len(args); i++ {
-		if i+1 < len(args) {
-			if (args[i] == "-i") && (input1 == "") {
-				input1 = args[i+1]
-				continue
-			}
-			if (args[i] == "-i") && (input1 != "") && (input2 == "") {
-				input2 = args[i+1]
-				continue
-			}
-		}
+// union returns the smallest crop area containing both c and o.
+func (c crop) union(o crop) crop {
+	x := c.x
+	if o.x < x {
+		x = o.x
+	}
+	y := c.y
+	if o.y < y {
+		y = o.y
+	}
+	right := c.x + c.w
+	if o.x+o.w > right {
+		right = o.x + o.w
+	}
+	bottom := c.y + c.h
+	if o.y+o.h > bottom {
+		bottom = o.y + o.h
 	}
-	if input2 == "" {
+	return crop{right - x, bottom - y, x, y}
+}
+
+// even returns crop with all values rounded down to multiples of 2.
+func (c crop) even() crop {
+	return crop{c.w - c.w%2, c.h - c.h%2, c.x - c.x%2, c.y - c.y%2}
+}
+
+// String returns crop values in ffmpeg crop filter format "w:h:x:y".
+func (c crop) String() string {
+	return strconv.Itoa(c.w) + ":" + strconv.Itoa(c.h) + ":" + strconv.Itoa(c.x) + ":" + strconv.Itoa(c.y)
+}
+
+// audioSync speeds up or slows down audio of the second and each following input to match duration of the first one.
+func audioSync(args []string, batchMode bool, opts options) (errors []string, input2 string, success bool) {
+	inputs := commandInputs(args)
+	if len(inputs) < 2 {
 		consolePrint("\x1b[31;1mERROR: sync mode requires two input files.\x1b[0m\n")
 		return
 	}
-	cmd := exec.Command("ffmpeg", "-i", input1, "-i", input2)
-	stdoutStderr, err := cmd.CombinedOutput()
-	if err != nil && fmt.Sprint(err) != "exit status 1" {
-		consolePrint("\x1b[31;1m", err, "\x1b[0m\n")
-		return
+	// Every following input is synced to the duration of the first one.
+	duration1 := getDuration(inputs[0])
+	success = true
+	for _, input := range inputs[1:] {
+		e, ok := syncInput(inputs[0], duration1, input, batchMode, opts)
+		errors = append(errors, e...)
+		success = success && ok
 	}
-	durations := regexpMap["durationHHMMSSMS"].FindAll(stdoutStderr, -1)
-	if len(durations) < 2 {
+	return errors, inputs[1], success
+}
+
+// syncInput speeds up or slows down audio of input2 to match duration1 of input1.
+func syncInput(input1 string, duration1 float64, input2 string, batchMode bool, opts options) (errors []string, success bool) {
+	duration2 := getDuration(input2)
+	if duration1 == 0 || duration2 == 0 {
 		consolePrint("\x1b[31;1mERROR: cannot determine durations for input files.\x1b[0m\n")
 		return
 	}
-	duration1String := regexpMap["durationHHMMSSMS"].ReplaceAllString(string(durations[0]), "${1}")
-	duration2String := regexpMap["durationHHMMSSMS"].ReplaceAllString(string(durations[1]), "${1}")
-	duration1 := hhmmssmsToSeconds(duration1String)
-	duration2 := hhmmssmsToSeconds(duration2String)
-	rate := round(48000 * duration2 / duration1)
-	if rate == 48000 {
-		consolePrint("\x1b[32m" + input1 + "\x1b[0m Duration: " + duration1String + "\n")
-		consolePrint("\x1b[32m" + input2 + "\x1b[0m Duration: " + duration2String + "\n")
+	rate := round(float64(opts.syncRate) * duration2 / duration1)
+	if rate == opts.syncRate {
+		consolePrint("\x1b[32m" + input1 + "\x1b[0m Duration: " + strconv.FormatFloat(duration1, 'f', 3, 64) + "s\n")
+		consolePrint("\x1b[32m" + input2 + "\x1b[0m Duration: " + strconv.FormatFloat(duration2, 'f', 3, 64) + "s\n")
 		consolePrint("\x1b[32;1mAudioSync is not needed.\x1b[0m\n")
+		success = true
 		return
 	}
 	basename := input2[0 : len(input2)-len(filepath.Ext(input2))]
-	errors, _ = encodeFile([]string{"-i",
+	ffCommand := []string{"-i",
 		input2,
 		"-af",
-		"asetrate=" + strconv.FormatInt(rate, 10) + ",aresample=48000",
-		"-vn",
-		"-acodec",
-		"flac",
-		"-compression_level",
-		"0",
+		"asetrate=" + strconv.FormatInt(rate, 10) + ",aresample=" + strconv.FormatInt(opts.syncRate, 10),
+		"-vn"}
+	ffCommand = append(ffCommand, syncFormats[opts.syncFormat]...)
+	ffCommand = append(ffCommand,
 		"-map_metadata",
 		"-1",
 		"-map_chapters",
 		"-1",
-		basename + "_SYNC.flac"}, batchMode, false, false)
+		basename+"_SYNC."+opts.syncFormat)
+	errors, _, success = encodeFile(ffCommand, batchMode, opts)
 	return
 }
 
-// "filterMapRange1":  regexp.MustCompile(`\[(\d+)-(\d+):(\d+)\]`),
-// "filterMapRange2":  regexp.MustCompile(`\[(\d+):(\d+)-(\d+)\]`),
-func convertFilterComplexInputs(in string) (string, error) {
-	if regexpMap["filterMapRange1"].MatchString(in) {
-		maps := regexpMap["filterMapRange1"].FindAllString(in, -1)
-		for _, a := range maps {
-			b := regexpMap["filterMapRange1"].FindStringSubmatch(a)
+// commandInputs returns values of all "-i" options of ffmpeg command.
+func commandInputs(ffCommand []string) []string {
+	inputs := []string{}
+	for i := 0; i+1 < len(ffCommand); i++ {
+		if ffCommand[i] == "-i" {
+			inputs = append(inputs, ffCommand[i+1])
+			i++
+		}
+	}
+	return inputs
+}
 
-			input1, err := strconv.Atoi(b[1])
-			if err != nil {
-				return "", err
-			}
-			input2, err := strconv.Atoi(b[2])
-			if err != nil {
-				return "", err
-			}
-			track, err := strconv.Atoi(b[3])
-			if err != nil {
-				return "", err
-			}
+// concatCodecOptions are options that set codecs of the output, stream copy is not added if any of them is present.
+var concatCodecOptions = []string{"-c", "-codec", "-c:v", "-codec:v", "-vcodec", "-c:a", "-codec:a", "-acodec"}
 
-			if input1 == input2 {
-				continue
-			}
+// concatEncode joins files with concat demuxer and encodes them with ffCommand.
+// Batch input at inputIndex of ffCommand is replaced with temporary concat list.
+// Streams are copied unless codecs are set in the command.
+func concatEncode(ffCommand []string, inputIndex int, files []string, opts options) (errors []string, firstInput string, success bool) {
+	f, err := ioutil.TempFile("", "fflite-concat-*.txt")
+	if err != nil {
+		return []string{"     \x1b[31;1mERROR: concat: " + err.Error() + "\x1b[0m\n"}, files[0], false
+	}
+	defer os.Remove(f.Name())
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		fmt.Fprintf(f, "file '%v'\n", strings.Replace(file, "'", `'\''`, -1))
+	}
+	f.Close()
 
-			c := ""
-			if input1 < input2 {
-				for i := input1; i <= input2; i++ {
-					c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(track) + "]"
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+	command := append([]string{}, ffCommand[:inputIndex-1]...)
+	command = append(command, "-f", "concat", "-safe", "0", "-i", f.Name())
+	copyStreams := true
+	for _, option := range concatCodecOptions {
+		if contains(ffCommand, option) {
+			copyStreams = false
+		}
+	}
+	if copyStreams {
+		command = append(command, "-c", "copy")
+	}
+	command = append(command, ffCommand[inputIndex+1:]...)
 
-			if input1 > input2 {
-				for i := input1; i >= input2; i-- {
-					c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(track) + "]"
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+	consolePrint("\x1b[30;1mCONCAT(", len(files), "): ", strings.Join(files, ", "), "\x1b[0m\n")
+	errors, _, success = encodeFile(command, false, opts)
+	// Stream copy fails if inputs have different codecs, find the first one that doesn't match.
+	if !success && copyStreams && !opts.dryRun {
+		if msg := concatMismatch(files); msg != "" {
+			line := "     \x1b[31;1mERROR: concat: " + msg + "\x1b[0m\n"
+			consolePrint(line)
+			errors = append(errors, line)
 		}
 	}
+	return errors, files[0], success
+}
 
-	if regexpMap["filterMapRange2"].MatchString(in) {
-		maps := regexpMap["filterMapRange2"].FindAllString(in, -1)
-		for _, a := range maps {
-			b := regexpMap["filterMapRange2"].FindStringSubmatch(a)
+// concatMismatch returns description of the first file with streams that don't match the first file.
+// Empty string is returned if all files have the same stream codecs.
+func concatMismatch(files []string) string {
+	streams := func(file string) string {
+		out, _ := exec.Command(ffprobeBin, "-v", "error", "-show_entries", "stream=codec_type,codec_name", "-of", "csv=p=0", file).Output()
+		return strings.Join(strings.Fields(string(out)), " ")
+	}
+	first := streams(files[0])
+	for _, file := range files[1:] {
+		if s := streams(file); s != first {
+			return "\"" + file + "\" streams (" + s + ") don't match \"" + files[0] + "\" streams (" + first + "), stream copy needs identical codecs, set codecs or a preset to re-encode"
+		}
+	}
+	return ""
+}
 
-			input, err := strconv.Atoi(b[1])
-			if err != nil {
-				return "", err
-			}
-			track1, err := strconv.Atoi(b[2])
+// twoPassEncode runs ffmpeg command twice for two-pass encoding.
+// The first pass writes to null sink with "-pass 1", the second one writes to the output with "-pass 2".
+// Output is the last argument of the command. Pass log files are removed afterwards.
+func twoPassEncode(ffCommand []string, batchMode bool, opts options) (errors []string, firstInput string, success bool) {
+	passlog := filepath.Join(os.TempDir(), "fflite2pass-"+strconv.Itoa(os.Getpid())+"-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	defer func() {
+		files, _ := filepath.Glob(passlog + "*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	last := len(ffCommand) - 1
+
+	pass1 := append([]string{}, ffCommand[:last]...)
+	pass1 = append(pass1, "-pass", "1", "-passlogfile", passlog, "-f", "null", nullSink())
+	// Don't ring the bell after the first pass.
+	pass1Opts := opts
+	pass1Opts.mute = true
+	consolePrint("\x1b[36;1mPASS 1 of 2\x1b[0m\n")
+	errors, firstInput, success = encodeFile(pass1, batchMode, pass1Opts)
+	if !success {
+		return
+	}
+
+	pass2 := append([]string{}, ffCommand[:last]...)
+	pass2 = append(pass2, "-pass", "2", "-passlogfile", passlog, ffCommand[last])
+	consolePrint("\x1b[36;1mPASS 2 of 2\x1b[0m\n")
+	errors2, _, success := encodeFile(pass2, batchMode, opts)
+	errors = append(errors, errors2...)
+	return
+}
+
+// malformedRanges returns stream specifiers with a dash that are left in filter_complex
+// string after ranges are expanded, like "[0-:1]" or "[0:a:-2]". They are passed to ffmpeg as is.
+func malformedRanges(in string) []string {
+	tokens := []string{}
+	for _, token := range regexpMap["malformedRange"].FindAllString(in, -1) {
+		if strings.Contains(token, "-") {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// convertFilterComplexInputs expands input ranges in filter_complex string.
+// "[0-1:1]" becomes "[0:1][1:1]", "[0:0-1]" becomes "[0:0][0:1]" and "[0-1:2-3]" becomes "[0:2][0:3][1:2][1:3]".
+// Stream type can be set as well, "[0:a:0-1]" becomes "[0:a:0][0:a:1]".
+// Inputs are the outer loop and streams the inner one, each range keeps its own direction,
+// so "[2-1:3-2]" becomes "[2:3][2:2][1:3][1:2]". Single-element ranges like "[0-0:1]" are left unchanged.
+func convertFilterComplexInputs(in string) (string, error) {
+	for _, b := range regexpMap["filterTypeRange"].FindAllStringSubmatch(in, -1) {
+		specs, err := expandTypedRange(b[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid input range %q: %v", b[0], err)
+		}
+		// Single-element ranges like "[0-0:a:1]" are passed as is.
+		if len(specs) == 1 {
+			continue
+		}
+		in = strings.ReplaceAll(in, b[0], "["+strings.Join(specs, "][")+"]")
+	}
+	for _, name := range []string{"filterMapRange1", "filterMapRange2", "filterMapRange3"} {
+		for _, b := range regexpMap[name].FindAllStringSubmatch(in, -1) {
+			n, err := atoiSlice(b[1:])
 			if err != nil {
-				return "", err
+				return "", fmt.Errorf("invalid input range %q: %v", b[0], err)
 			}
-			track2, err := strconv.Atoi(b[3])
-			if err != nil {
-				return "", err
+			var specs []string
+			switch name {
+			case "filterMapRange1":
+				specs = expandStreamRange(n[0], n[1], "", n[2], n[2])
+			case "filterMapRange2":
+				specs = expandStreamRange(n[0], n[0], "", n[1], n[2])
+			case "filterMapRange3":
+				specs = expandStreamRange(n[0], n[1], "", n[2], n[3])
 			}
-
-			if track1 == track2 {
+			if len(specs) == 1 {
 				continue
 			}
+			in = strings.ReplaceAll(in, b[0], "["+strings.Join(specs, "][")+"]")
+		}
+	}
+	return in, nil
+}
 
-			c := ""
-			if track1 < track2 {
-				for t := track1; t <= track2; t++ {
-					c += "[" + strconv.Itoa(input) + ":" + strconv.Itoa(t) + "]"
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+// convertMapRange expands -map value range into a slice of stream specifiers.
+// "0:1-3" becomes ["0:1", "0:2", "0:3"], "0:a:0-1" becomes ["0:a:0", "0:a:1"], values without range are returned as is.
+func convertMapRange(in string) ([]string, error) {
+	if b := regexpMap["mapTypeRange"].FindStringSubmatch(in); b != nil && strings.Contains(in, "-") {
+		return expandTypedRange(b[1:])
+	}
+	b := regexpMap["mapRange"].FindStringSubmatch(in)
+	if b == nil || !strings.Contains(in, "-") {
+		return []string{in}, nil
+	}
+	// Use range start as range end if range is not set.
+	if b[2] == "" {
+		b[2] = b[1]
+	}
+	if b[4] == "" {
+		b[4] = b[3]
+	}
+	n, err := atoiSlice(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	return expandStreamRange(n[0], n[1], "", n[2], n[3]), nil
+}
 
-			if track1 > track2 {
-				for t := track1; t >= track2; t-- {
-					c += "[" + strconv.Itoa(input) + ":" + strconv.Itoa(t) + "]"
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+// expandMapRanges expands ranges of -map values in args, like the ones coming from presets.
+// "@check0:2-3" becomes "-map 0:2 -map 0:3 -scodec srt ...".
+func expandMapRanges(args []string) ([]string, error) {
+	out := []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-map" || i+1 == len(args) {
+			out = append(out, args[i])
+			continue
+		}
+		maps, err := convertMapRange(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range maps {
+			out = append(out, "-map", m)
 		}
+		i++
 	}
+	return out, nil
+}
 
-	if regexpMap["filterMapRange3"].MatchString(in) {
-		maps := regexpMap["filterMapRange3"].FindAllString(in, -1)
-		for _, a := range maps {
-			b := regexpMap["filterMapRange3"].FindStringSubmatch(a)
+// expandTypedRange expands submatches of "filterTypeRange" or "mapTypeRange" regexps:
+// input range start, optional input range end, stream type, stream range start and optional stream range end.
+func expandTypedRange(b []string) ([]string, error) {
+	// Use range start as range end if range is not set.
+	if b[1] == "" {
+		b[1] = b[0]
+	}
+	if b[4] == "" {
+		b[4] = b[3]
+	}
+	n, err := atoiSlice([]string{b[0], b[1], b[3], b[4]})
+	if err != nil {
+		return nil, err
+	}
+	return expandStreamRange(n[0], n[1], b[2], n[2], n[3]), nil
+}
 
-			input1, err := strconv.Atoi(b[1])
-			if err != nil {
-				return "", err
-			}
-			input2, err := strconv.Atoi(b[2])
-			if err != nil {
-				return "", err
+// expandStreamRange returns "input:stream" or "input:type:stream" specifiers for all inputs from input1 to input2
+// and all streams from stream1 to stream2. Descending ranges are expanded in reverse order.
+func expandStreamRange(input1, input2 int, streamType string, stream1, stream2 int) []string {
+	if streamType != "" {
+		streamType += ":"
+	}
+	var specs []string
+	for _, i := range numberRange(input1, input2) {
+		for _, t := range numberRange(stream1, stream2) {
+			specs = append(specs, strconv.Itoa(i)+":"+streamType+strconv.Itoa(t))
+		}
+	}
+	return specs
+}
+
+// numberRange returns all integers from a to b, in reverse order if a is greater than b.
+func numberRange(a, b int) []int {
+	var out []int
+	if a <= b {
+		for i := a; i <= b; i++ {
+			out = append(out, i)
+		}
+		return out
+	}
+	for i := a; i >= b; i-- {
+		out = append(out, i)
+	}
+	return out
+}
+
+// atoiSlice converts slice of strings into slice of integers.
+func atoiSlice(in []string) ([]int, error) {
+	out := make([]int, len(in))
+	for i, v := range in {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// hwFamilies are name parts of ffmpeg hardware encoders.
+var hwFamilies = []string{"nvenc", "qsv", "vaapi", "videotoolbox", "amf"}
+
+// hwCheck prints hardware acceleration methods and hardware encoders supported by ffmpeg build.
+// Each encoder is tested with a short encode to check if the hardware is actually present.
+func hwCheck() {
+	out, err := exec.Command(ffmpegBin, "-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		os.Exit(1)
+	}
+	var hwaccels []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasSuffix(line, ":") {
+			hwaccels = append(hwaccels, line)
+		}
+	}
+	consolePrint("\x1b[33;1mHardware acceleration methods:\x1b[0m ")
+	if len(hwaccels) == 0 {
+		consolePrint("\x1b[30;1mnone\x1b[0m\n")
+	} else {
+		consolePrint(strings.Join(hwaccels, ", ") + "\n")
+	}
+
+	out, err = exec.Command(ffmpegBin, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		consolePrint("\x1b[31;1mERROR: ", err, "\x1b[0m\n")
+		os.Exit(1)
+	}
+	encoders := map[string][]string{}
+	scanner = bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Encoder lines look like " V....D h264_nvenc  NVIDIA NVENC H.264 encoder (codec h264)".
+		if len(fields) < 2 || len(fields[0]) != 6 || fields[0][0] != 'V' {
+			continue
+		}
+		for _, family := range hwFamilies {
+			if strings.Contains(fields[1], family) {
+				encoders[family] = append(encoders[family], fields[1])
 			}
-			track1, err := strconv.Atoi(b[3])
-			if err != nil {
-				return "", err
+		}
+	}
+	consolePrint("\x1b[33;1mHardware encoders:\x1b[0m\n")
+	for _, family := range hwFamilies {
+		consolePrint("    " + truncPad(family, 13, 'l'))
+		if len(encoders[family]) == 0 {
+			consolePrint("\x1b[30;1mnot supported by ffmpeg build\x1b[0m\n")
+			continue
+		}
+		for i, encoder := range encoders[family] {
+			if i > 0 {
+				consolePrint(" ")
 			}
-			track2, err := strconv.Atoi(b[4])
-			if err != nil {
-				return "", err
+			if hwEncoderWorks(encoder) {
+				consolePrint("\x1b[32;1m" + encoder + "\x1b[0m")
+			} else {
+				consolePrint("\x1b[31m" + encoder + "\x1b[0m")
 			}
+		}
+		consolePrint("\n")
+	}
+	consolePrint("\x1b[30;1mGreen encoders are working, red ones are not available on this machine.\x1b[0m\n")
+}
 
-			if input1 == input2 && track1 == track2 {
-				continue
-			}
+// hwEncoderWorks reports whether encoder can encode a few frames of a test source.
+func hwEncoderWorks(encoder string) bool {
+	args := []string{"-hide_banner", "-v", "error", "-f", "lavfi", "-i", "color=s=640x360:d=0.2", "-frames:v", "5"}
+	// VAAPI encoders need frames uploaded to hardware surface.
+	if strings.Contains(encoder, "vaapi") {
+		args = append([]string{"-vaapi_device", "/dev/dri/renderD128"}, args...)
+		args = append(args, "-vf", "format=nv12,hwupload")
+	}
+	args = append(args, "-c:v", encoder, "-f", "null", nullSink())
+	return exec.Command(ffmpegBin, args...).Run() == nil
+}
 
-			c := ""
-			if input1 < input2 {
-				for i := input1; i <= input2; i++ {
-					if track1 < track2 {
-						for t := track1; t <= track2; t++ {
-							c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(t) + "]"
-						}
-						continue
-					}
-					if track1 > track2 {
-						for t := track1; t >= track2; t-- {
-							c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(t) + "]"
-						}
-						continue
-					}
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+// stderrTailLength is the number of last ffmpeg output lines saved to error log on unrecognized failure.
+const stderrTailLength = 10
 
-			if input1 > input2 {
-				for i := input1; i >= input2; i-- {
-					if track1 < track2 {
-						for t := track1; t <= track2; t++ {
-							c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(t) + "]"
-						}
-						continue
-					}
-					if track1 > track2 {
-						for t := track1; t >= track2; t-- {
-							c += "[" + strconv.Itoa(i) + ":" + strconv.Itoa(t) + "]"
-						}
-						continue
-					}
-				}
-				in = strings.ReplaceAll(in, b[0], c)
-				continue
-			}
+// hideBanner prepends "-hide_banner" to ffmpeg arguments, so version and build configuration
+// lines are not matched as errors or warnings. Arguments are returned as is if the banner
+// is already hidden or -loglevel asks for verbose output, which includes the banner.
+func hideBanner(ffCommand []string) []string {
+	if contains(ffCommand, "-hide_banner") {
+		return ffCommand
+	}
+	if level, ok := loglevel(ffCommand); ok && level >= loglevels["verbose"] {
+		return ffCommand
+	}
+	return append([]string{"-hide_banner"}, ffCommand...)
+}
+
+// loglevels are numeric values of ffmpeg loglevel names.
+var loglevels = map[string]int{"quiet": -8, "panic": 0, "fatal": 8, "error": 16, "warning": 24, "info": 32, "verbose": 40, "debug": 48, "trace": 56}
+
+// loglevel returns numeric value of -loglevel or -v option of ffmpeg command.
+// ok is false if loglevel is not set or can't be parsed.
+func loglevel(ffCommand []string) (level int, ok bool) {
+	for i := len(ffCommand) - 2; i >= 0; i-- {
+		if ffCommand[i] != "-loglevel" && ffCommand[i] != "-v" {
+			continue
+		}
+		value := ffCommand[i+1]
+		// Skip "repeat+level+" flags.
+		if n := strings.LastIndex(value, "+"); n != -1 {
+			value = value[n+1:]
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			return n, true
 		}
+		level, ok = loglevels[value]
+		return level, ok
 	}
+	return 0, false
+}
 
-	return in, nil
+// startFFmpeg starts cmd with niceness set by -nice option.
+func startFFmpeg(cmd *exec.Cmd) error {
+	setNiceAttr(cmd, ffmpegNice)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if ffmpegNice != 0 {
+		if err := setNiceProcess(cmd.Process, ffmpegNice); err != nil {
+			consolePrint("\x1b[33;1mWARNING: can't set niceness: " + err.Error() + "\x1b[0m\n")
+		}
+	}
+	return nil
 }
 
 // encodeFile starts ffmpeg command with passed arguments in ffCommand []string array.
-func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray []string, firstInput string) {
-	var printCommand, progress, lastLine, lastLineUsed, lastLineFull string
-	var warningArray []string
-	var duration, prevSecond float64
+// success reports whether ffmpeg exited successfully.
+func encodeFile(ffCommand []string, batchMode bool, opts options) (errorsArray []string, firstInput string, success bool) {
+	var printCommand, progress, lastLine, lastLineUsed, lastLineFull, statsRaw, pendingStream, lastStatsTime string
+	var warningArray, outputs []string
+	var duration, totalFrames, prevSecond float64
 	var speedArray []float64
+	var stats progressStats
 	var encodingStarted, encodingFinished, streamMapping, sigint bool
 	var startTime time.Time
 	var prevUptime time.Duration
 	var warningSpam map[string]bool
 	warningSpam = make(map[string]bool)
 
-	// Intercept Interrupt signal
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	// Append the command to the script file before fflite specific progress pipe is added.
+	if opts.emitScript != "" {
+		args := ffCommand
+		if !opts.ffmpeg && !opts.banner {
+			args = hideBanner(ffCommand)
+		}
+		appendScript(opts.emitScript, ffmpegBin, args)
+	}
 
-	go func() {
-		<-c
-		sigint = true
-	}()
+	// Read progress from ffmpeg -progress output on file descriptor 3 instead of stats lines.
+	if opts.progressPipe {
+		ffCommand = append([]string{"-progress", "pipe:3", "-nostats"}, ffCommand...)
+	}
 
 	// Print out the final ffmpeg command and add quotes to arguments that contain spaces.
-	printCommand = "\x1b[36;1m> \x1b[30;1m" + "ffmpeg"
+	printCommand = "\x1b[36;1m> \x1b[30;1m" + ffmpegBin
 	for _, v := range ffCommand {
 		if strings.Contains(v, " ") {
 			v = "\"" + v + "\""
@@ -933,7 +3381,9 @@ func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray [
 		printCommand += " " + v
 	}
 	printCommand += "\x1b[0m\n"
-	consolePrint(printCommand)
+	if !opts.quiet {
+		consolePrint(printCommand)
+	}
 
 	// Find the first input.
 	for i := 0; i < len(ffCommand); i++ {
@@ -944,8 +3394,18 @@ func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray [
 		}
 	}
 
+	// Don't start ffmpeg in dry run mode.
+	if opts.dryRun {
+		success = true
+		return
+	}
+
 	// Create exec command to start ffmpeg with.
-	cmd := exec.Command("ffmpeg", ffCommand...)
+	args := ffCommand
+	if !opts.ffmpeg && !opts.banner {
+		args = hideBanner(ffCommand)
+	}
+	cmd := exec.Command(ffmpegBin, args...)
 	// Pipe stderr (default ffmpeg info channel) to terminal.
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -954,31 +3414,251 @@ func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray [
 	// Pipe terminals stdin to executed ffmpeg instance.
 	// Used for answering ffmpegs questions.
 	cmd.Stdin = os.Stdin
+	// In pause mode stdin is passed to ffmpeg through fflite to catch the pause key.
+	var stdinPipe io.WriteCloser
+	restoreTerminal := func() {}
+	if opts.pause {
+		restore, err := setCbreak()
+		if err != nil {
+			consolePrint("\x1b[33;1mWARNING: " + err.Error() + "\x1b[0m\n")
+		} else {
+			restoreTerminal = restore
+			defer restoreTerminal()
+			cmd.Stdin = nil
+			stdinPipe, err = cmd.StdinPipe()
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
 	// Pipe ffmpegs stdout to fflite to allow piping of output.
 	cmd.Stdout = os.Stdout
+	// Pass the write end of progress pipe to ffmpeg as file descriptor 3.
+	var progressReader *os.File
+	if opts.progressPipe {
+		r, w, err := os.Pipe()
+		if err != nil {
+			log.Panic(err)
+		}
+		progressReader = r
+		cmd.ExtraFiles = []*os.File{w}
+		defer r.Close()
+	}
+	// Fit progress lines into the terminal and follow its resizing.
+	updateTermWidth()
+	widthDone := make(chan struct{})
+	defer close(widthDone)
+	watchTermWidth(widthDone)
+	// Remember files that existed before the start, so only the ones ffmpeg created are cleaned up.
+	var existed map[string]bool
+	if opts.cleanOnFail {
+		existed = existingFiles(ffCommand)
+	}
 	// Start ffmpeg.
-	cmd.Start()
+	startErr := startFFmpeg(cmd)
+	// Close the write end in fflite, so reading stops when ffmpeg exits.
+	if opts.progressPipe {
+		cmd.ExtraFiles[0].Close()
+	}
+	// Process state is never set if ffmpeg didn't start, don't wait for it.
+	if startErr != nil {
+		line := "     \x1b[31;1mERROR: can't start ffmpeg: " + startErr.Error() + "\x1b[0m\n"
+		consolePrint(line)
+		errorsArray = append(errorsArray, line)
+		exitStatus = 1
+		return errorsArray, firstInput, false
+	}
+
+	// paused is 1 while ffmpeg is stopped in pause mode.
+	var paused int32
+
+	// Intercept Interrupt signal.
+	// First signal lets ffmpeg stop and flush the output, second one within two seconds kills it.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(c)
+		close(c)
+	}()
+	go func() {
+		var last time.Time
+		for range c {
+			// Stopped ffmpeg can't handle the signal, resume it first.
+			if atomic.LoadInt32(&paused) == 1 && cmd.Process != nil {
+				resumeProcess(cmd.Process)
+			}
+			if sigint && time.Since(last) < 2*time.Second {
+				consolePrint("\n\x1b[31;1mSIGINT: killing ffmpeg\x1b[0m\n")
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				restoreTerminal()
+				showCursor()
+				os.Exit(1)
+			}
+			sigint = true
+			last = time.Now()
+		}
+	}()
+	// Kill ffmpeg if there was no progress for stallTimeout once encoding has started.
+	// lastProgress holds the time of the last progress line in nanoseconds, 0 disarms the watchdog.
+	var lastProgress, stalled int64
+	watchdogDone := make(chan struct{})
+	if opts.stallTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-watchdogDone:
+					return
+				case <-ticker.C:
+					last := atomic.LoadInt64(&lastProgress)
+					if last != 0 && time.Since(time.Unix(0, last)) > opts.stallTimeout {
+						atomic.StoreInt64(&stalled, 1)
+						if cmd.Process != nil {
+							cmd.Process.Kill()
+						}
+						return
+					}
+				}
+			}
+		}()
+	}
+	// Toggle pause with "p" key, pass all other keys to ffmpeg.
+	keysDone := make(chan struct{})
+	if stdinPipe != nil {
+		go func() {
+			// Watchdog timer value before the pause.
+			var armed int64
+			keys := stdinKeys()
+			for {
+				select {
+				case <-keysDone:
+					return
+				case key, ok := <-keys:
+					if !ok {
+						return
+					}
+					if key != 'p' {
+						stdinPipe.Write([]byte{key})
+						continue
+					}
+					if atomic.LoadInt32(&paused) == 0 {
+						if err := pauseProcess(cmd.Process); err != nil {
+							continue
+						}
+						atomic.StoreInt32(&paused, 1)
+						// Don't let watchdog kill paused ffmpeg.
+						armed = atomic.SwapInt64(&lastProgress, 0)
+						consolePrint("\r" + truncPad("\x1b[33;1mPAUSED\x1b[0m press p to resume", 79, 'l') + "\r")
+					} else {
+						resumeProcess(cmd.Process)
+						atomic.StoreInt32(&paused, 0)
+						if armed != 0 {
+							atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+						}
+					}
+				}
+			}
+		}()
+	}
 	// Buffer all the messages coming from ffmpegs stderr.
 	scanner := bufio.NewScanner(stderr)
-	// Split the lines on `\r?\n`, '\r', "[y/N]".
+	// Split the lines on `\r?\n`, '\r', "[y/N]" and "(y/N)".
 	scanner.Split(scanLines)
+	// Merge stderr lines and status lines built from progress pipe.
+	lines := make(chan ffmpegLine)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for scanner.Scan() {
+			lines <- ffmpegLine{text: scanner.Text()}
+		}
+	}()
+	if progressReader != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readProgress(progressReader, lines)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
 	// For each line.
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !ffmpeg {
+	// Last lines of ffmpeg output without status lines, saved to error log if ffmpeg fails without matched errors.
+	var stderrTail []string
+	var matchedErrors bool
+	// Time of the last printed progress update and minimal interval between updates.
+	var lastPrinted time.Time
+	progressInterval := opts.throttle
+	if progressNewline && progressInterval < time.Second {
+		progressInterval = time.Second
+	}
+	if !isTerminal && opts.throttle == 0 {
+		progressInterval = 5 * time.Second
+	}
+	for next := range lines {
+		line := next.text
+		if opts.debug {
+			debugPrint(line)
+		}
+		if strings.TrimSpace(line) != "" && !regexpMap["encoding"].MatchString(line) && !regexpMap["encodingNoSpeed"].MatchString(line) {
+			stderrTail = append(stderrTail, line)
+			if len(stderrTail) > stderrTailLength {
+				stderrTail = stderrTail[1:]
+			}
+		}
+		if !opts.ffmpeg {
+			isError := false
+			isStream := false
+			throttled := false
 			// Check the state of the program.
 			switch {
 			case !encodingStarted && regexpMap["streamMapping"].MatchString(line):
 				streamMapping = true
 			case !encodingStarted && streamMapping && !strings.Contains(line, "->"):
 				streamMapping = false
-			case !encodingStarted && (regexpMap["encoding"].MatchString(line) || regexpMap["encodingNoSpeed"].MatchString(line)) && regexpMap["currentSecond"].ReplaceAllString(line, "$1") != "00:00:00.00":
+			// Don't start encoding again on stats lines printed after the finish of the first output.
+			case !encodingStarted && !encodingFinished && (regexpMap["encoding"].MatchString(line) || regexpMap["encodingNoSpeed"].MatchString(line)) && regexpMap["currentSecond"].ReplaceAllString(line, "$1") != "00:00:00.00":
 				startTime = time.Now()
-				prevUptime = time.Since(startTime)
+				prevUptime = 0
+				prevSecond = hhmmssmsToSeconds(regexpMap["currentSecond"].ReplaceAllString(line, "$1"))
 				streamMapping = false
 				encodingStarted = true
+				atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+				// Use frame count for progress if duration is unknown.
+				// Image sequence duration is implied from its number of frames and framerate.
+				// Duration line is not printed below info loglevel, probe it instead.
+				// Pipes and streams are not probed, ffprobe would read the data ffmpeg is encoding.
+				if level, ok := loglevel(ffCommand); ok && level < loglevels["info"] && duration <= 0 && !isStreamInput(firstInput) {
+					duration = getDuration(firstInput)
+				}
+				if duration <= 0 && !isStreamInput(firstInput) {
+					frames := float64(opts.totalFrames)
+					if frames <= 0 {
+						frames = sequenceFrames(firstInput)
+					}
+					if frames > 0 {
+						duration = frames / inputFramerate(ffCommand)
+					} else {
+						totalFrames = probeFrames(firstInput)
+					}
+				}
+				// ffmpeg reports single progress for all outputs, label them.
+				if len(outputs) > 1 && !opts.quiet {
+					consolePrint("\x1b[30;1m  Progress of " + strconv.Itoa(len(outputs)) + " outputs: " + strings.Join(outputs, ", ") + "\x1b[0m\n")
+				}
 			case encodingStarted && regexpMap["encodingFinished"].MatchString(line):
 				encodingStarted, encodingFinished = parseFinish(line, sigint, progress, lastLine, startTime)
+				atomic.StoreInt64(&lastProgress, 0)
+			}
+			// Keep the last stats line for the stats trailer.
+			if regexpMap["currentSecond"].MatchString(line) {
+				statsRaw = line
 			}
 			// Modify the lines using regexp.
 			switch {
@@ -987,32 +3667,87 @@ func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray [
 			case regexpMap["input"].MatchString(line):
 				line = parseInput(line)
 			case regexpMap["output"].MatchString(line):
+				outputs = append(outputs, regexpMap["output"].FindStringSubmatch(line)[2])
 				line = parseOutput(line)
 			case regexpMap["duration"].MatchString(line):
 				line, duration = parseDuration(line)
 			case regexpMap["stream"].MatchString(line):
 				line = parseStream(line)
+				isStream = true
+			case regexpMap["handler"].MatchString(line) && opts.handlers && pendingStream != "":
+				line = streamHandler(pendingStream, line)
+				pendingStream = ""
 			case regexpMap["handler"].MatchString(line):
 				line = parseHandler(line)
+			case regexpMap["warnings"].MatchString(line) && opts.quiet:
+				line = ""
 			case regexpMap["warnings"].MatchString(line):
-				line, warningArray = parseWarnings(line, lastLineFull, warningArray, warningSpam)
+				line, warningArray = parseWarnings(line, lastLineFull, warningArray, warningSpam, opts.warnLimit)
 			case regexpMap["hide"].MatchString(line):
 				line = ""
 			case encodingStarted:
+				statsTime := ""
+				if m := regexpMap["currentSecond"].FindStringSubmatch(line); m != nil {
+					statsTime = m[1]
+				}
 				switch {
-				case regexpMap["encoding"].MatchString(line):
-					line, lastLine, progress, speedArray = parseEncoding(line, lastLineFull, duration, speedArray)
+				// Stats lines arriving close together can report the same time,
+				// they would add zero-progress samples to the ETA speed average.
+				// The final "Lsize=" line is always parsed.
+				case statsTime != "" && statsTime == lastStatsTime && !strings.Contains(line, "Lsize="):
+					line = ""
+					throttled = true
+				// Lines from -progress output don't need "speed=" to be parsed.
+				case regexpMap["encoding"].MatchString(line) || next.progress != nil:
+					line, lastLine, progress, speedArray, stats = parseEncoding(line, lastLineFull, duration, totalFrames, startTime, next.progress, speedArray, opts.etaWindow, opts.decimalPercent)
+					writeProgressJSON(opts.progressFile, stats)
+					atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+					if !progressDue(&lastPrinted, progressInterval) {
+						line = ""
+						throttled = true
+					}
 				case regexpMap["encodingNoSpeed"].MatchString(line):
-					line, lastLine, progress, speedArray = parseEncodingNoSpeed(line, lastLineFull, duration, startTime, prevUptime, prevSecond, speedArray)
+					line, lastLine, progress, speedArray, stats = parseEncodingNoSpeed(line, lastLineFull, duration, totalFrames, startTime, &prevUptime, &prevSecond, speedArray, opts.etaWindow, opts.decimalPercent)
+					writeProgressJSON(opts.progressFile, stats)
+					atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+					if !progressDue(&lastPrinted, progressInterval) {
+						line = ""
+						throttled = true
+					}
 				default:
 					line, lastLineUsed, errorsArray = parseEncodingErrors(line, lastLineFull, lastLineUsed, lastLine, errorsArray, progress)
+					isError = true
+				}
+				if statsTime != "" {
+					lastStatsTime = statsTime
 				}
 			case regexpMap["errors"].MatchString(line):
 				line, errorsArray = parseErrors(line, lastLineFull, batchMode, errorsArray)
+				isError = true
 			default:
 				line = ""
 			}
-			lastLineFull = line
+			if isError {
+				matchedErrors = true
+			}
+			// Print only errors in quiet mode.
+			if opts.quiet && !isError {
+				line = ""
+			}
+			// Hold stream line until its handler name arrives, print it as is if anything else comes first.
+			if opts.handlers {
+				switch {
+				case isStream:
+					line, pendingStream = pendingStream, line
+				case line != "" && pendingStream != "":
+					consolePrint(pendingStream)
+					pendingStream = ""
+				}
+			}
+			// Keep the last printed progress line for padding of the next one.
+			if !throttled {
+				lastLineFull = line
+			}
 			if line != "" {
 				consolePrint(line)
 			}
@@ -1023,13 +3758,52 @@ func encodeFile(ffCommand []string, batchMode, ffmpeg, mute bool) (errorsArray [
 	}
 	// Wait for ffmpeg to finish.
 	cmd.Wait()
-	if !cmd.ProcessState.Success() {
+	if pendingStream != "" {
+		consolePrint(pendingStream)
+	}
+	close(watchdogDone)
+	close(keysDone)
+	// Summary line is not printed below info loglevel, finish with the last progress line.
+	if encodingStarted && !encodingFinished && (cmd.ProcessState.Success() || sigint) {
+		_, encodingFinished = parseFinish(lastLineFull, sigint, progress, lastLine, startTime)
+	}
+	if atomic.LoadInt64(&stalled) == 1 {
+		if (lastLineFull != "") && (lastLineFull[len(lastLineFull)-1]) == '\r' {
+			consolePrint("\n")
+		}
+		line := "     \x1b[31;1mERROR: no progress for " + opts.stallTimeout.String() + ", ffmpeg was killed\x1b[0m\n"
+		consolePrint(line)
+		errorsArray = append(errorsArray, line)
+	}
+	success = cmd.ProcessState.Success()
+	if !success {
 		exitStatus = 1
 	}
+	// Remove half-written outputs, so they are not mistaken for complete ones.
+	if opts.cleanOnFail && (!success || sigint) {
+		removePartialOutputs(append(outputs, ffCommand[len(ffCommand)-1]), ffCommand, existed)
+	}
+	// Save exit code and the tail of ffmpeg output if it failed without any recognized errors.
+	if !success && !sigint && atomic.LoadInt64(&stalled) == 0 {
+		if (lastLineFull != "") && (lastLineFull[len(lastLineFull)-1]) == '\r' {
+			consolePrint("\n")
+		}
+		line := "     \x1b[31;1mERROR: ffmpeg exited with code " + strconv.Itoa(cmd.ProcessState.ExitCode()) + "\x1b[0m\n"
+		consolePrint(line)
+		errorsArray = append(errorsArray, line)
+		if !matchedErrors {
+			for _, v := range stderrTail {
+				errorsArray = append(errorsArray, "     \x1b[30;1m"+v+"\x1b[0m\n")
+			}
+		}
+	}
 	// If at least one file was encoded.
 	if encodingFinished && !batchMode {
+		if opts.statsLine && !opts.ffmpeg {
+			fmt.Fprint(os.Stderr, statsTrailer(statsRaw, time.Since(startTime)))
+		}
 		// Play bell sound.
-		bell(mute)
+		bell(opts.mute, !success)
 	}
 	return
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecondsToHHMMSS(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		// Seconds are rounded to the nearest second.
+		{"359999.9", "100:00:00"},
+		{"3600", "01:00:00"},
+		{"59.999", "00:01:00"},
+	}
+	for _, tt := range tests {
+		if got := secondsToHHMMSS(tt.in); got != tt.want {
+			t.Errorf("secondsToHHMMSS(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHhmmssmsToSecondsComma(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"00:01:02,500", 62.5},
+		{"1:02,5", 62.5},
+		{"90,25", 90.25},
+	}
+	for _, tt := range tests {
+		if got := hhmmssmsToSeconds(tt.in); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("hhmmssmsToSeconds(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// twoOutputsFFmpeg is a fake ffmpeg splitting video and audio of a 10 seconds input into two outputs.
+const twoOutputsFFmpeg = `#!/bin/sh
+cat >&2 <<'EOF'
+Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'a.mp4':
+  Duration: 00:00:10.00, start: 0.000000, bitrate: 1000 kb/s
+Stream mapping:
+  Stream #0:0 -> #0:0 (copy)
+  Stream #0:1 -> #1:0 (copy)
+Output #0, mp4, to 'v.mp4':
+Output #1, ipod, to 'a.m4a':
+Press [q] to stop, [?] for help
+EOF
+printf 'frame=  100 fps=0.0 q=-1.0 size=    1024kB time=00:00:04.00 bitrate=2000.0kbits/s speed=8x    \n' >&2
+printf 'frame=  200 fps=0.0 q=-1.0 size=    2048kB time=00:00:08.00 bitrate=2000.0kbits/s speed=8x    \n' >&2
+cat >&2 <<'EOF'
+[out#0/mp4 @ 0x1] video:2000kB audio:0kB subtitle:0kB other streams:0kB global headers:0kB muxing overhead: 0.1%
+[out#1/ipod @ 0x2] video:0kB audio:160kB subtitle:0kB other streams:0kB global headers:0kB muxing overhead: 0.1%
+EOF
+printf 'frame=  250 fps=0.0 q=-1.0 Lsize=    2500kB time=00:00:10.00 bitrate=2000.0kbits/s speed=8x    \n' >&2
+`
+
+func TestEncodeFileTwoOutputs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "fflite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(bin, []byte(twoOutputsFFmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	progressFile, err := os.Create(filepath.Join(dir, "progress.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer progressFile.Close()
+
+	// Collect fflite output from stdout.
+	oldBin, oldTerminal, oldStdout := ffmpegBin, isTerminal, os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffmpegBin, isTerminal, os.Stdout = bin, false, w
+	output := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- string(b)
+	}()
+	errorsArray, _, success := encodeFile([]string{"-i", "a.mp4", "-map", "0:v", "v.mp4", "-map", "0:a", "a.m4a"}, false, options{etaWindow: 30, progressFile: progressFile})
+	w.Close()
+	ffmpegBin, isTerminal, os.Stdout = oldBin, oldTerminal, oldStdout
+	out := <-output
+
+	if !success || len(errorsArray) != 0 {
+		t.Fatalf("encodeFile() success = %v, errors = %q", success, errorsArray)
+	}
+	if !strings.Contains(out, "Progress of 2 outputs: v.mp4, a.m4a") {
+		t.Errorf("output has no label of both outputs:\n%v", out)
+	}
+	// Single progress of both outputs goes up once, the second output summary doesn't restart it.
+	if _, err := progressFile.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var percents []float64
+	scanner := bufio.NewScanner(progressFile)
+	for scanner.Scan() {
+		var stats progressStats
+		if err := json.Unmarshal(scanner.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		percents = append(percents, stats.Percent)
+	}
+	want := []float64{40, 80}
+	if !reflect.DeepEqual(percents, want) {
+		t.Errorf("progress percents = %v, want %v", percents, want)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`list:"a b.mp4" c.mp4`, []string{"a b.mp4", "c.mp4"}},
+		{`list:"weird\"name".mp4`, []string{`weird"name.mp4`}},
+		{"list:a.mp4\tb.mp4 \t c.mp4", []string{"a.mp4", "b.mp4", "c.mp4"}},
+	}
+	for _, tt := range tests {
+		got, err := sliceFromFileOrGlob(tt.in, false)
+		if err != nil {
+			t.Errorf("sliceFromFileOrGlob(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sliceFromFileOrGlob(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got, err := sliceFromFileOrGlob(`list:"a b.mp4 c.mp4`, false); err == nil {
+		t.Errorf("sliceFromFileOrGlob with unterminated quote = %q, want error", got)
+	}
+}
+
+func TestArgsPreset(t *testing.T) {
+	got := argsPreset("@scale1280x720")
+	want := []string{"-vf", "scale=1280:720,setsar=1/1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("argsPreset(%q) = %q, want %q", "@scale1280x720", got, want)
+	}
+}
+
+func TestCheckPresetGroups(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{`^\@scale(\d+)x(\d+)$`, "-vf scale=${1}:${2}", true},
+		{`^\@crf(\d+)$`, "-crf $1", true},
+		{`^\@crf(\d+)$`, "-crf ${2}", false},
+		{`^\@fast$`, "-preset $1", false},
+	}
+	for _, tt := range tests {
+		err := checkPresetGroups(regexp.MustCompile(tt.key), tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPresetGroups(%q, %q) error = %v, want ok %v", tt.key, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestMalformedRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"[0-:1]amerge[a]", []string{"[0-:1]"}},
+		{"[-1:0]amerge[a]", []string{"[-1:0]"}},
+		{"[0:a:-2]amerge[a]", []string{"[0:a:-2]"}},
+		{"[0:1][0-:1][0:a:-2]concat[a]", []string{"[0-:1]", "[0:a:-2]"}},
+		{"[0-1:1]amerge[a]", nil},
+		{"[0:a:0-2]amerge[a]", nil},
+		{"[1-0:2-3]concat=n=2[v]", nil},
+		{"[0:v]scale=1280:-2[v]", nil},
+	}
+	for _, tt := range tests {
+		// Ranges are checked once they are expanded.
+		in, err := convertFilterComplexInputs(tt.in)
+		if err != nil {
+			t.Errorf("convertFilterComplexInputs(%q) error: %v", tt.in, err)
+			continue
+		}
+		got := malformedRanges(in)
+		if len(got) != len(tt.want) {
+			t.Errorf("malformedRanges(%q) = %q, want %q", in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("malformedRanges(%q) = %q, want %q", in, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestConvertFilterComplexInputs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"[0-1:1]", "[0:1][1:1]"},
+		{"[0:0-1]", "[0:0][0:1]"},
+		{"[0-1:2-3]", "[0:2][0:3][1:2][1:3]"},
+		{"[0:a:0-2]", "[0:a:0][0:a:1][0:a:2]"},
+		// Inputs are the outer loop, each range keeps its own direction.
+		{"[2-1:3-2]", "[2:3][2:2][1:3][1:2]"},
+		{"[1-2:3-2]", "[1:3][1:2][2:3][2:2]"},
+		{"[2-1:2-3]", "[2:2][2:3][1:2][1:3]"},
+		{"[1-2:2-3]", "[1:2][1:3][2:2][2:3]"},
+		// Single-element ranges are left unchanged.
+		{"[0-0:1]", "[0-0:1]"},
+		{"[0:1-1]", "[0:1-1]"},
+		{"[1-1:a:0-0]", "[1-1:a:0-0]"},
+		{"[0-0:1-2]", "[0:1][0:2]"},
+	}
+	for _, tt := range tests {
+		got, err := convertFilterComplexInputs(tt.in)
+		if err != nil {
+			t.Errorf("convertFilterComplexInputs(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("convertFilterComplexInputs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripEscapesFromString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"\x1b[33;1m 50%\x1b[0m eta=00:00:10", " 50% eta=00:00:10"},
+		{"\x1b[?25lhidden\x1b[?25h", "hidden"},
+		{"\x1b[2K\rline", "\rline"},
+		{"\x1b[1Aup\x1b[31;1mERROR\x1b[0m", "upERROR"},
+	}
+	for _, tt := range tests {
+		if got := stripEscapesFromString(tt.in); got != tt.want {
+			t.Errorf("stripEscapesFromString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScanLinesPrompt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"File 'out.mp4' already exists. Overwrite? [y/N] ", "File 'out.mp4' already exists. Overwrite? [y/N] "},
+		{"File 'out.mp4' already exists. Overwrite? [y/N]", "File 'out.mp4' already exists. Overwrite? [y/N]"},
+		{"Overwrite? (y/N) ", "Overwrite? (y/N) "},
+	}
+	for _, tt := range tests {
+		// ffmpeg waits for the answer, so the prompt must be returned before EOF.
+		advance, token, err := scanLines([]byte(tt.in), false)
+		if err != nil || advance != len(tt.in) || string(token) != tt.want {
+			t.Errorf("scanLines(%q, false) = %v, %q, %v, want %v, %q, nil", tt.in, advance, token, err, len(tt.in), tt.want)
+		}
+	}
+}
+
+func TestParseEncodingNoSpeedETA(t *testing.T) {
+	// Samples of 2x encoding of 100 seconds input, uptime is simulated with the start time.
+	samples := []struct {
+		uptime time.Duration
+		line   string
+		eta    string
+	}{
+		{time.Second, "frame=   50 fps=25 q=-1.0 size=    1024kB time=00:00:02.00 bitrate=2000.0kbits/s", "00:00:49"},
+		{2 * time.Second, "frame=  100 fps=25 q=-1.0 size=    2048kB time=00:00:04.00 bitrate=2000.0kbits/s", "00:00:48"},
+		// Repeated time has unknown speed, it doesn't change the average.
+		{2500 * time.Millisecond, "frame=  100 fps=25 q=-1.0 size=    2048kB time=00:00:04.00 bitrate=2000.0kbits/s", "00:00:48"},
+		{3 * time.Second, "frame=  150 fps=25 q=-1.0 size=    3072kB time=00:00:06.00 bitrate=2000.0kbits/s", "00:00:47"},
+	}
+	var prevUptime time.Duration
+	var prevSecond float64
+	var speedArray []float64
+	var stats progressStats
+	for i, s := range samples {
+		_, _, _, speedArray, stats = parseEncodingNoSpeed(s.line, "", 100, 0, time.Now().Add(-s.uptime), &prevUptime, &prevSecond, speedArray, 30, false)
+		if stats.ETA != s.eta {
+			t.Errorf("sample %v: eta = %q, want %q", i, stats.ETA, s.eta)
+		}
+		if math.IsNaN(stats.Speed) {
+			t.Errorf("sample %v: speed is NaN", i)
+		}
+	}
+	if len(speedArray) != 3 {
+		t.Errorf("speed samples = %v, want 3 of them", speedArray)
+	}
+	// NaN sample is skipped as well.
+	eta, got := getETA(math.NaN(), 100, 6, speedArray, 30)
+	if eta != "47" || len(got) != 3 {
+		t.Errorf("getETA(NaN) = %q, %v, want %q and 3 speed samples", eta, got, "47")
+	}
+}
+
+func TestParseEncodingNoSpeedProgress(t *testing.T) {
+	var prevUptime time.Duration
+	var prevSecond float64
+	line := "frame=  625 fps=25 q=-1.0 size=    6144kB time=00:00:25.00 bitrate=2000.0kbits/s"
+	_, _, progress, _, _ := parseEncodingNoSpeed(line, "", 100, 0, time.Now().Add(-5*time.Second), &prevUptime, &prevSecond, nil, 30, false)
+	if progress != " 25" {
+		t.Errorf("parseEncodingNoSpeed() progress = %q, want %q", progress, " 25")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setNiceAttr does nothing on Unix, niceness is set after the process is started.
+func setNiceAttr(cmd *exec.Cmd, nice int) {}
+
+// setNiceProcess sets niceness of the started process.
+func setNiceProcess(p *os.Process, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, p.Pid, nice)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Windows process priority classes.
+const (
+	idlePriorityClass        = 0x00000040
+	belowNormalPriorityClass = 0x00004000
+	aboveNormalPriorityClass = 0x00008000
+	highPriorityClass        = 0x00000080
+)
+
+// setNiceAttr sets priority class closest to Unix niceness before the process is started.
+func setNiceAttr(cmd *exec.Cmd, nice int) {
+	var class uint32
+	switch {
+	case nice >= 15:
+		class = idlePriorityClass
+	case nice > 0:
+		class = belowNormalPriorityClass
+	case nice <= -15:
+		class = highPriorityClass
+	case nice < 0:
+		class = aboveNormalPriorityClass
+	default:
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= class
+}
+
+// setNiceProcess does nothing on Windows, priority class is set on process creation.
+func setNiceProcess(p *os.Process, nice int) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errPauseNotSupported = errors.New("pause is not supported on Windows")
+
+// pauseProcess is not supported on Windows.
+func pauseProcess(p *os.Process) error {
+	return errPauseNotSupported
+}
+
+// resumeProcess is not supported on Windows.
+func resumeProcess(p *os.Process) error {
+	return errPauseNotSupported
+}
+
+// setCbreak is not supported on Windows.
+func setCbreak() (restore func(), err error) {
+	return nil, errPauseNotSupported
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchTermWidth updates terminal width on SIGWINCH until done is closed.
+func watchTermWidth(done chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				updateTermWidth()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,5 @@
+package main
+
+// watchTermWidth does nothing on Windows, there is no SIGWINCH.
+// Terminal width is only queried at the start of each encode.
+func watchTermWidth(done chan struct{}) {}